@@ -3,18 +3,17 @@ package api
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"kickstart/common"
 	"kickstart/config"
-	"log"
 	"net"
 	"net/http"
-	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -25,7 +24,7 @@ import (
 	validation "github.com/go-ozzo/ozzo-validation"
 	"github.com/go-ozzo/ozzo-validation/is"
 	"github.com/gorilla/mux"
-	"github.com/mdlayher/arp"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
@@ -39,9 +38,17 @@ type KS struct {
 	Hostname      string   `json:"hostname"`
 	VLANID        *int     `json:"vlanid"`
 	CLI           []string `json:"cli"`
+	SecretCLI     []int    `json:"secretcli,omitempty"`
 	Keyboard      string   `json:"keyboard"`
 	ISOFilename   string   `json:"isofilename"`
 	NotVmPgCreate bool     `json:"notvmpgcreate"`
+	SecureBoot    bool     `json:"secureboot"`
+}
+
+// KSTemplateData is rendered into esxi-ks.cfg.
+type KSTemplateData struct {
+	KS
+	CompletionURL string
 }
 
 type Server struct {
@@ -50,12 +57,19 @@ type Server struct {
 	FileRootDirInfo *config.FileRootDirInfo
 	logger          *zap.Logger
 	cfg             *config.Config
+	store           *common.Store
+	events          *common.EventBus
+	auditor         *Auditor
+	auth            *authenticator
+	limiter         *rateLimiter
+	// uploadSlots holds a value for each upload in progress, up to MAX_CONCURRENT_UPLOADS.
+	uploadSlots chan struct{}
 }
 
 func (k KS) Validate() error {
 	return validation.ValidateStruct(&k,
 		validation.Field(&k.Macaddress, validation.Required, is.MAC.Error("invalid mac address format")),
-		validation.Field(&k.Password, validation.Required, is.ASCII.Error("invalid string type")),
+		validation.Field(&k.Password, validation.Required, is.ASCII.Error("invalid string type"), validation.By(validatePasswordHash)),
 		validation.Field(&k.IP, validation.Required, is.IPv4.Error("invalid ipv4 address")),
 		validation.Field(&k.Netmask, validation.Required, is.IP.Error("invalid subnet mask error")),
 		validation.Field(&k.Gateway, validation.Required, is.IPv4.Error("invalid gateway address")),
@@ -63,250 +77,630 @@ func (k KS) Validate() error {
 		validation.Field(&k.Hostname, validation.Required, is.DNSName.Error("invalid hostname")),
 		validation.Field(&k.VLANID, validation.Min(0), validation.Max(4094)),
 		validation.Field(&k.CLI, validation.Each(is.ASCII.Error("invalid string type"))),
+		validation.Field(&k.SecretCLI, validation.By(k.validateSecretCLI)),
 		validation.Field(&k.Keyboard, is.ASCII.Error("invalid string type")),
 		validation.Field(&k.ISOFilename, validation.Required),
 		validation.Field(&k.NotVmPgCreate),
+		validation.Field(&k.SecureBoot),
 	)
 }
 
+// validatePasswordHash rejects passwords that look like a SHA-512 crypt hash but are not a valid one,
+// since they would otherwise be hashed again as a plaintext password.
+func validatePasswordHash(value interface{}) error {
+	password, _ := value.(string)
+	if strings.HasPrefix(password, "$6$") && !common.IsSHA512Crypt(password) {
+		return errors.New("invalid SHA-512 crypt hash")
+	}
+	return nil
+}
+
+// hashPassword replaces the root password of k by its SHA-512 crypt hash, so that the plaintext is never stored.
+func (k *KS) hashPassword() error {
+	hash, err := common.HashPassword(k.Password)
+	if err != nil {
+		return err
+	}
+	k.Password = hash
+	return nil
+}
+
+// getKsConfig serves the ks.cfg of the host whose ks token is in the path, counting it as a use of the token,
+// or of the host leased the IP of the client for boot.cfg files without ks token.
 func (s *Server) getKsConfig(w http.ResponseWriter, r *http.Request) {
 	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		s.logger.Error("error parsing client IP address", zap.Error(err))
-		http.Error(w, "invalid client IP address", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, "invalid client IP address")
 		return
 	}
-	ksFilePath := filepath.Join(s.KSDirPath, clientIP, "/ks.cfg")
+	var mac string
+	var found bool
+	if token, ok := mux.Vars(r)["token"]; ok {
+		mac, err = s.store.UseKSToken(token, s.cfg.KSTokenMaxUses)
+		if err == common.ErrKSTokenGone {
+			s.logger.Error(fmt.Sprintf("%s sent the used up or expired ks token of MAC %s", clientIP, mac))
+			writeError(w, r, http.StatusGone, "ks token is used up or expired")
+			return
+		}
+		if err == common.ErrKSTokenNotFound {
+			s.logger.Error(fmt.Sprintf("no registration found for the ks token sent by %s", clientIP))
+			writeError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		if err != nil {
+			s.logger.Error("failed to record use of ks token", zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+			return
+		}
+	} else {
+		if !s.cfg.KSFallbackToIP {
+			s.logger.Error(fmt.Sprintf("%s requested a ks.cfg without ks token", clientIP))
+			writeError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		mac, found = s.store.MacByIP(net.ParseIP(clientIP))
+		if !found {
+			s.logger.Error(fmt.Sprintf("no registration found for client IP %s", clientIP))
+			writeError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+	}
+	ksFilePath := s.ksFilePath(mac)
 	s.logger.Info(fmt.Sprintf("received GET request. KS file path is %s", ksFilePath))
 
 	file, err := os.Open(ksFilePath)
 	if err != nil {
 		s.logger.Error("error opening file", zap.Error(err))
-		http.Error(w, "encountered unexpected problem", http.StatusInternalServerError)
+		s.fail(mac, err)
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
 		return
 	}
 	file.Close()
 	http.ServeFile(w, r, ksFilePath)
+	s.transition(mac, common.PhaseKsFetched)
+	s.events.Publish(common.Event{Type: common.EventKsFetched, Macaddress: mac, IP: clientIP, File: "ks.cfg"})
+}
+
+// completionURL returns the URL that the installed host calls back from %firstboot, carrying its completion token.
+// The callback is served by the boot listener only.
+func (s *Server) completionURL(mac, token string) string {
+	addr := s.cfg.CallbackServerAddr
+	if addr == "" {
+		addr = s.cfg.ServicePortAddr.String()
+	}
+	url := &url.URL{
+		Scheme: config.InstallerScheme(s.cfg),
+		Host:   net.JoinHostPort(addr, strconv.Itoa(s.cfg.BootServerPort)),
+		Path:   fmt.Sprintf("/ks/%s/complete", strings.Replace(mac, ":", "-", -1)),
+	}
+	// The token is appended as is, so that previews can show a placeholder in its place.
+	return url.String() + "/" + token
+}
+
+// completeKsConfig marks the installation of a host as completed, when called back with the completion token of the host.
+// With AUTO_CLEANUP_ON_COMPLETE, the registration is deleted as well, which is recorded in the audit log.
+func (s *Server) completeKsConfig(w http.ResponseWriter, r *http.Request) {
+	mac := macFromID(mux.Vars(r)["id"])
+
+	reg, found := s.store.Get(mac)
+	if !found {
+		s.logger.Error(fmt.Sprintf("no registration found for MAC %s", mac))
+		writeError(w, r, http.StatusNotFound, "registration not found")
+		return
+	}
+	token := mux.Vars(r)["token"]
+	if token == "" || reg.CompletionToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(reg.CompletionToken)) != 1 {
+		s.logger.Warn(fmt.Sprintf("%s reported completion of MAC %s without its completion token", r.RemoteAddr, mac))
+		writeError(w, r, http.StatusForbidden, "invalid completion token")
+		return
+	}
+	if s.transition(mac, common.PhaseCompleted) {
+		s.events.Publish(common.Event{Type: common.EventCompleted, Macaddress: mac})
+	}
+	s.logger.Info(fmt.Sprintf("installation of MAC %s has completed", mac))
+
+	if s.cfg.AutoCleanupOnComplete {
+		err := s.deleteMapManager(mac)
+		entry := AuditEntry{
+			Time:       time.Now(),
+			Action:     auditAction(r),
+			RemoteAddr: r.RemoteAddr,
+			Target:     mac,
+			Payload:    map[string]interface{}{"auto_cleanup": true},
+			Status:     http.StatusOK,
+			Result:     "success",
+		}
+		if err != nil {
+			entry.Status = http.StatusInternalServerError
+			entry.Result = "failure"
+		}
+		if auditErr := s.auditor.Record(entry); auditErr != nil {
+			s.logger.Error("failed to record audit entry", zap.Error(auditErr))
+		}
+		if err != nil {
+			s.logger.Error("failed to exec deleteMapManager", zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+			return
+		}
+	}
+}
+
+// transition moves the installation of mac forward to phase and returns whether it moved.
+func (s *Server) transition(mac string, phase common.Phase) bool {
+	moved, err := s.store.Transition(mac, phase)
+	if err != nil {
+		if err != common.ErrRegistrationNotFound {
+			s.logger.Error("failed to update installation status", zap.Error(err))
+		}
+		return false
+	}
+	if moved {
+		s.logger.Info(fmt.Sprintf("installation of MAC %s moved to %s phase", mac, phase))
+	}
+	return moved
+}
+
+// fail marks the installation of mac as failed.
+func (s *Server) fail(mac string, reason error) {
+	failed, err := s.store.Fail(mac, reason.Error())
+	if err != nil {
+		if err != common.ErrRegistrationNotFound {
+			s.logger.Error("failed to update installation status", zap.Error(err))
+		}
+		return
+	}
+	if failed {
+		s.events.Publish(common.Event{Type: common.EventFailed, Macaddress: mac, Message: reason.Error()})
+	}
+}
+
+// clientMac returns the MAC address of the registered host sending r.
+func (s *Server) clientMac(r *http.Request) (string, bool) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", false
+	}
+	return s.store.MacByIP(net.ParseIP(clientIP))
+}
+
+type StatusResponse struct {
+	Macaddress  string                   `json:"macaddress"`
+	IP          string                   `json:"ip,omitempty"`
+	ISOFilename string                   `json:"isofilename"`
+	Phase       common.Phase             `json:"phase"`
+	Error       string                   `json:"error,omitempty"`
+	History     []common.PhaseTransition `json:"history"`
+}
+
+func (s *Server) getKsStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	mac := macFromID(id)
+
+	reg, found := s.store.Get(mac)
+	if !found {
+		s.logger.Error(fmt.Sprintf("no registration found for MAC %s", mac))
+		writeError(w, r, http.StatusNotFound, "registration not found")
+		return
+	}
+
+	status := StatusResponse{
+		Macaddress:  reg.Macaddress,
+		ISOFilename: reg.ISOFilename,
+		Phase:       reg.Lifecycle.Phase,
+		Error:       reg.Lifecycle.Error,
+		History:     reg.Lifecycle.History,
+	}
+	if reg.IP != nil {
+		status.IP = reg.IP.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
 }
 
 func (s Server) deleteKsConfig(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	mac := strings.Replace(id, "-", ":", -1)
+	mac := macFromID(id)
 
 	if mac == "" {
 		s.logger.Error("mac address does not exist")
-		http.Error(w, "mac address is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "mac address is required")
 		return
 	}
 
+	reg, found := s.store.Get(mac)
 	err := s.deleteMapManager(mac)
 	if err != nil {
 		s.logger.Error("failed to exec deleteMapManager", zap.Error(err))
-		http.Error(w, "encountered unexpected problem", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
 		return
 	}
+	if found {
+		s.events.Publish(common.Event{Type: common.EventDeleted, Macaddress: mac, Hostname: reg.Hostname})
+	}
+}
+
+// resetKsToken issues a new ks token to a registered host, for it to fetch its ks.cfg again once its token is used up or expired.
+func (s *Server) resetKsToken(w http.ResponseWriter, r *http.Request) {
+	mac := macFromID(mux.Vars(r)["id"])
+
+	err := s.store.ResetKSToken(mac)
+	if err == common.ErrRegistrationNotFound {
+		s.logger.Error(fmt.Sprintf("no registration found for MAC %s", mac))
+		writeError(w, r, http.StatusNotFound, "registration not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to reset ks token", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+	s.logger.Info(fmt.Sprintf("reset ks token of MAC %s", mac))
 }
 
 func (s *Server) deleteMapManager(mac string) error {
-	common.MacIPMapMutex.Lock()
-	defer common.MacIPMapMutex.Unlock()
-	delete(common.MacIPMap, mac)
-	s.logger.Info(fmt.Sprintf("deleted macIPMap mapping for MAC %s", mac))
+	err := s.store.Delete(mac)
+	if err != nil {
+		return err
+	}
+	s.logger.Info(fmt.Sprintf("deleted registration for MAC %s", mac))
 
-	common.MacFileMapMutex.Lock()
-	defer common.MacFileMapMutex.Unlock()
-	delete(common.MacFileMap, mac)
-	s.logger.Info(fmt.Sprintf("Deleted macFileMap mapping for MAC %s", mac))
+	err = os.RemoveAll(filepath.Dir(s.ksFilePath(mac)))
+	if err != nil {
+		return err
+	}
+	s.logger.Info(fmt.Sprintf("deleted ks config for MAC %s", mac))
 
 	return nil
 }
 
+// ksFilePath returns where the rendered ks.cfg of a MAC address is kept.
+// Files are keyed by MAC address so that they stay valid when the PXE IP changes.
+func (s *Server) ksFilePath(mac string) string {
+	return filepath.Join(s.KSDirPath, strings.Replace(mac, ":", "-", -1), "ks.cfg")
+}
+
 func (s *Server) createKsConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Content-Type") != "application/json" {
 		s.logger.Error("invalid Content-Type received")
-		http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+		writeError(w, r, http.StatusUnsupportedMediaType, "invalid Content-Type")
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		s.logger.Error("could not read request body", zap.Error(err))
-		http.Error(w, "encountered unexpected problem", http.StatusInternalServerError)
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w, r, s.cfg.MaxRequestBodySize)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
 		return
 	}
 
 	var ks KS
-	err = json.Unmarshal([]byte(body), &ks)
-	if err != nil {
-		s.logger.Error("could not unmarshall request body", zap.Error(err))
-		if syntaxErr, ok := err.(*json.SyntaxError); ok {
-			http.Error(w, fmt.Sprintf("invalid JSON format. (at position %d)", syntaxErr.Offset), http.StatusBadRequest)
-			return
-		}
-		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
-			http.Error(w, fmt.Sprintf("type of %q value is invalid. expected type is %v, but got type is %v (at position %d)", typeErr.Field, typeErr.Type, typeErr.Value, typeErr.Offset), http.StatusBadRequest)
-			return
-		}
-		http.Error(w, "encountered unexpected problem", http.StatusInternalServerError)
+	if !s.decodeKS(w, r, body, &ks) {
 		return
 	}
+	ks.Macaddress = strings.ToLower(ks.Macaddress)
 
 	err = ks.Validate()
 	if err != nil {
 		s.logger.Error("validate request error", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeValidationError(w, r, err)
 		return
 	}
 
-	kscfg, err := template.ParseFS(common.GetKsTemplatefiles(), "templates/esxi-ks.cfg")
+	err = s.validateISO(ks)
+	if err != nil {
+		s.logger.Error("validate iso error", zap.Error(err))
+		writeValidationError(w, r, err)
+		return
+	}
+
+	common.RegistrationMutex.Lock()
+	defer common.RegistrationMutex.Unlock()
+	conflicts := s.registrationConflicts(ks, registeredHosts(s.store.List()))
+	if conflict := s.reregistrationConflict(ks); conflict != "" && !forced(r) {
+		conflicts = append(conflicts, conflict)
+	}
+	if len(conflicts) > 0 {
+		s.logger.Error(fmt.Sprintf("registration of MAC %s conflicts with existing registrations: %s", ks.Macaddress, strings.Join(conflicts, "; ")))
+		writeConflicts(w, r, conflicts)
+		return
+	}
+
+	err = ks.hashPassword()
 	if err != nil {
-		s.logger.Error("failed to parse", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.logger.Error("failed to hash password", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
 		return
 	}
 
 	err = s.isoFileMapManager(ks.Macaddress, ks.ISOFilename)
 	if err != nil {
 		s.logger.Error("error saving MAC to IsoFilename mappings", zap.Error(err))
-		http.Error(w, "encountered unexpected problem", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "encountered unexpected problem")
 		return
 	}
 
-	err = s.macAddressManager(ks.Macaddress, s.DHCPLeaseConfig)
+	payload, err := json.Marshal(ks)
 	if err != nil {
-		s.logger.Error("error saving MAC to IP mappings", zap.Error(err))
-		http.Error(w, "encountered unexpected problem", http.StatusBadRequest)
+		s.logger.Error("failed to encode registration", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+	err = s.store.Update(ks.Macaddress, func(reg *common.Registration) error {
+		reg.Hostname = ks.Hostname
+		reg.KS = payload
+		if err := reg.IssueCompletionToken(); err != nil {
+			return err
+		}
+		return reg.IssueKSToken()
+	})
+	if err != nil {
+		s.logger.Error("error saving MAC to registration mappings", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
 		return
 	}
 
-	ksfolder := filepath.Join(s.KSDirPath, common.MacIPMap[ks.Macaddress].String())
-	err = os.MkdirAll(ksfolder, os.ModePerm)
+	err = s.macAddressManager(ks.Macaddress, s.DHCPLeaseConfig)
 	if err != nil {
-		s.logger.Error("failed to create ks directory", zap.Error(err))
-		http.Error(w, "encountered unexpected problem", http.StatusInternalServerError)
+		s.logger.Error("error saving MAC to IP mappings", zap.Error(err))
+		writeError(w, r, http.StatusBadRequest, "encountered unexpected problem")
 		return
 	}
 
-	file, err := os.Create(ksfolder + "/ks.cfg")
+	err = s.writeKsConfig(ks)
 	if err != nil {
-		s.logger.Error("failed to create ks config file", zap.Error(err))
-		http.Error(w, "encountered unexpected problem", http.StatusInternalServerError)
+		s.logger.Error("failed to write ks config file", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
 		return
 	}
-	defer file.Close()
-	kscfg.Execute(file, ks)
+	s.transition(ks.Macaddress, common.PhaseRegistered)
+	s.events.Publish(common.Event{Type: common.EventRegistered, Macaddress: ks.Macaddress})
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(body))
+	if err := writeJSON(w, http.StatusOK, ks.redacted()); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+	}
 }
 
-func (s *Server) isoFileMapManager(mac, isoname string) error {
-	common.MacFileMapMutex.Lock()
-	defer common.MacFileMapMutex.Unlock()
-	common.MacFileMap[mac] = isoname
-	s.logger.Info(fmt.Sprintf("update bootFilename %s to MAC %s", isoname, mac))
-	return nil
+// decodeKS decodes a registration request body into ks, answering the client itself when the body is invalid.
+func (s *Server) decodeKS(w http.ResponseWriter, r *http.Request, body []byte, ks *KS) bool {
+	err := json.Unmarshal(body, ks)
+	if err != nil {
+		s.logger.Error("could not unmarshall request body", zap.Error(err))
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid JSON format. (at position %d)", syntaxErr.Offset))
+			return false
+		}
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("type of %q value is invalid. expected type is %v, but got type is %v (at position %d)", typeErr.Field, typeErr.Type, typeErr.Value, typeErr.Offset))
+			return false
+		}
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return false
+	}
+	return true
 }
 
-func (s *Server) macAddressManager(mac string, dhcpInfo *config.DHCPLeaseConfig) error {
-	common.MacAddressManagerMutex.Lock()
-	defer common.MacAddressManagerMutex.Unlock()
-
-	common.MacIPMapMutex.RLock()
-	ip, ok := common.MacIPMap[mac]
-	common.MacIPMapMutex.RUnlock()
+// renderKsConfig renders the ks.cfg of ks into w, with completionToken in its completion URL.
+func (s *Server) renderKsConfig(w io.Writer, ks KS, completionToken string) error {
+	kscfg, err := template.ParseFS(common.GetKsTemplatefiles(), "templates/esxi-ks.cfg")
+	if err != nil {
+		return fmt.Errorf("failed to parse ks template: %w", err)
+	}
+	return kscfg.Execute(w, KSTemplateData{KS: ks, CompletionURL: s.completionURL(ks.Macaddress, completionToken)})
+}
 
-	if ok {
-		s.logger.Info(fmt.Sprintf("MAC %s already has IP %s assigned", mac, ip))
-	} else {
-		availableIP := FindAvailableIP(common.MacIPMap, dhcpInfo)
+// writeKsConfig renders the ks.cfg of ks.
+func (s *Server) writeKsConfig(ks KS) error {
+	completionToken, err := s.store.CompletionToken(ks.Macaddress)
+	if err != nil {
+		return fmt.Errorf("failed to issue completion token: %w", err)
+	}
+	ksFilePath := s.ksFilePath(ks.Macaddress)
+	err = os.MkdirAll(filepath.Dir(ksFilePath), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create ks directory: %w", err)
+	}
 
-		if availableIP != nil {
-			updateMacToIPMap(mac, availableIP)
-			s.logger.Info(fmt.Sprintf("assigned IP %s to MAC %s", availableIP, mac))
-		} else {
-			return errors.New("any IPs available in the specified range")
-		}
+	file, err := os.Create(ksFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create ks config file: %w", err)
 	}
-	return nil
+	defer file.Close()
+	return s.renderKsConfig(file, ks, completionToken)
 }
 
-func updateMacToIPMap(mac string, ip net.IP) {
-	common.MacIPMapMutex.Lock()
-	defer common.MacIPMapMutex.Unlock()
-	common.MacIPMap[mac] = ip
+// stageKsConfig writes the ks.cfg of ks next to its final path, to be put in place with os.Rename
+// once the registration is stored, and returns where it was written.
+func (s *Server) stageKsConfig(ks KS, completionToken string) (string, error) {
+	var kscfg bytes.Buffer
+	err := s.renderKsConfig(&kscfg, ks, completionToken)
+	if err != nil {
+		return "", err
+	}
+	stagedPath := s.ksFilePath(ks.Macaddress) + ".new"
+	err = os.MkdirAll(filepath.Dir(stagedPath), os.ModePerm)
+	if err != nil {
+		return "", fmt.Errorf("failed to create ks directory: %w", err)
+	}
+	err = os.WriteFile(stagedPath, kscfg.Bytes(), 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create ks config file: %w", err)
+	}
+	return stagedPath, nil
 }
 
-func FindAvailableIP(usedIPs map[string]net.IP, dhcpConfig *config.DHCPLeaseConfig) net.IP {
-	start := ipToInt(dhcpConfig.DHCPStartIP)
-	end := ipToInt(dhcpConfig.DHCPEndIP)
+// updateKsConfig replaces the registration of a MAC address with PUT, or changes only the fields sent with PATCH.
+// The ks.cfg is rendered again and the PXE IP already assigned to the MAC address is kept.
+func (s *Server) updateKsConfig(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	mac := macFromID(id)
 
-	used := make(map[uint32]bool)
-	for _, ip := range usedIPs {
-		used[ipToInt(ip)] = true
+	if r.Header.Get("Content-Type") != "application/json" {
+		s.logger.Error("invalid Content-Type received")
+		writeError(w, r, http.StatusUnsupportedMediaType, "invalid Content-Type")
+		return
 	}
 
-	for i := start; i <= end; i++ {
-		if !used[i] {
-			ip := intToIP(i)
-			if !isIPUsed(ip, dhcpConfig.DHCPInterfaceName) {
-				return ip
-			}
+	reg, found := s.store.Get(mac)
+	if !found {
+		s.logger.Error(fmt.Sprintf("no registration found for MAC %s", mac))
+		writeError(w, r, http.StatusNotFound, "registration not found")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Error("could not read request body", zap.Error(err))
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w, r, s.cfg.MaxRequestBodySize)
+			return
 		}
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
 	}
-	return nil
-}
 
-func ipToInt(ip net.IP) uint32 {
-	ipv4Int := binary.BigEndian.Uint32(ip.To4())
-	return ipv4Int
-}
+	stored, err := registrationKS(reg)
+	if err != nil {
+		s.logger.Error("failed to read registration", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+	var ks KS
+	if r.Method == "PATCH" {
+		if stored == nil {
+			s.logger.Error(fmt.Sprintf("registration of MAC %s has no stored request to patch", mac))
+			writeError(w, r, http.StatusConflict, "registration cannot be patched, use PUT instead")
+			return
+		}
+		ks = *stored
+		// The lists are decoded into copies, so that the stored ones are left to restore masked values from.
+		ks.CLI = append([]string(nil), stored.CLI...)
+		ks.SecretCLI = append([]int(nil), stored.SecretCLI...)
+	}
+	if !s.decodeKS(w, r, body, &ks) {
+		return
+	}
+	if r.Method == "PATCH" && replacesCLIOnly(body) {
+		ks.SecretCLI = nil
+	}
+	if stored != nil {
+		ks.restoreRedacted(*stored)
+	}
 
-func intToIP(ipInt uint32) net.IP {
-	ip := make(net.IP, 4)
-	binary.BigEndian.PutUint32(ip, ipInt)
-	return ip
-}
+	if ks.Macaddress != "" && !strings.EqualFold(ks.Macaddress, reg.Macaddress) {
+		s.logger.Error(fmt.Sprintf("attempted to change macaddress of MAC %s to %s", reg.Macaddress, ks.Macaddress))
+		writeError(w, r, http.StatusBadRequest, "macaddress cannot be changed")
+		return
+	}
+	ks.Macaddress = reg.Macaddress
+
+	err = ks.Validate()
+	if err != nil {
+		s.logger.Error("validate request error", zap.Error(err))
+		writeValidationError(w, r, err)
+		return
+	}
 
-func isIPUsed(searchIP net.IP, servicePortName string) bool {
-	// Ensure valid network interface
-	ifi, err := net.InterfaceByName(servicePortName)
+	err = s.validateISO(ks)
 	if err != nil {
-		log.Fatal(err)
+		s.logger.Error("validate iso error", zap.Error(err))
+		writeValidationError(w, r, err)
+		return
 	}
 
-	// Check if the interface itself has the IP
-	addrs, err := ifi.Addrs()
+	err = ks.hashPassword()
 	if err != nil {
-		log.Fatal(err)
+		s.logger.Error("failed to hash password", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
 	}
-	for _, addr := range addrs {
-		// Check if the address is the one we're searching for
-		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(searchIP) {
-			return true
-		}
+
+	common.RegistrationMutex.Lock()
+	defer common.RegistrationMutex.Unlock()
+	if conflicts := s.registrationConflicts(ks, registeredHosts(s.store.List())); len(conflicts) > 0 {
+		s.logger.Error(fmt.Sprintf("update of MAC %s conflicts with existing registrations: %s", ks.Macaddress, strings.Join(conflicts, "; ")))
+		writeConflicts(w, r, conflicts)
+		return
+	}
+
+	err = s.isoFileMapManager(ks.Macaddress, ks.ISOFilename)
+	if err != nil {
+		s.logger.Error("error saving MAC to IsoFilename mappings", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+
+	payload, err := json.Marshal(ks)
+	if err != nil {
+		s.logger.Error("failed to encode registration", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+	err = s.store.Update(ks.Macaddress, func(reg *common.Registration) error {
+		reg.Hostname = ks.Hostname
+		reg.KS = payload
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("error saving MAC to registration mappings", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
 	}
 
-	// Set up ARP client with socket
-	c, err := arp.Dial(ifi)
+	err = s.macAddressManager(ks.Macaddress, s.DHCPLeaseConfig)
 	if err != nil {
-		log.Fatal(err)
+		s.logger.Error("error saving MAC to IP mappings", zap.Error(err))
+		writeError(w, r, http.StatusBadRequest, "encountered unexpected problem")
+		return
 	}
-	defer c.Close()
 
-	// Set request deadline
-	if err := c.SetDeadline(time.Now().Add(1 * time.Second)); err != nil {
-		log.Fatal(err)
+	err = s.writeKsConfig(ks)
+	if err != nil {
+		s.logger.Error("failed to write ks config file", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
 	}
+	s.logger.Info(fmt.Sprintf("updated registration of MAC %s", ks.Macaddress))
+	s.events.Publish(common.Event{Type: common.EventUpdated, Macaddress: ks.Macaddress})
+
+	if err := writeJSON(w, http.StatusOK, ks.redacted()); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+	}
+}
+
+func (s *Server) isoFileMapManager(mac, isoname string) error {
+	err := s.store.Upsert(mac, func(reg *common.Registration) error {
+		reg.ISOFilename = isoname
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.Info(fmt.Sprintf("update bootFilename %s to MAC %s", isoname, mac))
+	return nil
+}
 
-	// Request hardware address for IP address
-	ip, err := netip.ParseAddr(searchIP.String())
+func (s *Server) macAddressManager(mac string, dhcpInfo *config.DHCPLeaseConfig) error {
+	ip, assigned, err := s.store.AssignIP(mac, dhcpInfo)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	if assigned {
+		s.logger.Info(fmt.Sprintf("assigned IP %s to MAC %s", ip, mac))
+	} else {
+		s.logger.Info(fmt.Sprintf("MAC %s already has IP %s assigned", mac, ip))
 	}
-	_, err = c.Resolve(ip)
-	return err == nil
+	return nil
 }
 
 type Response struct {
@@ -319,41 +713,22 @@ func (s *Server) esxiVersionList(w http.ResponseWriter, r *http.Request) {
 	filepath.Walk(s.FileRootDirInfo.BootFileDirPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			s.logger.Error("failed to find boot file directory", zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, err.Error())
 			return err
 		}
 		if info.IsDir() && filepath.Dir(path) == s.FileRootDirInfo.BootFileDirPath {
-			xmlPath := filepath.Join(path, "esxi", "upgrade", "metadata.xml")
-			xmlFile, err := os.Open(xmlPath)
-			if err != nil {
-				s.logger.Error("failed to open metadata.xml", zap.Error(err))
-				return err
-			}
-			defer xmlFile.Close()
-
-			xmlData, err := io.ReadAll(xmlFile)
+			version, err := readEsxiVersion(path)
 			if err != nil {
 				s.logger.Error("failed to read metadata.xml", zap.Error(err))
 				return err
 			}
-
-			var vum common.Vum
-			decoder := xml.NewDecoder(bytes.NewReader(xmlData))
-			decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
-				return input, nil
-			}
-			err = decoder.Decode(&vum)
-			if err != nil {
-				s.logger.Error("failed to decode metadata.xml", zap.Error(err))
-				return err
-			}
-			uploadedFiles[filepath.Base(path)] = vum.Product.EsxVersion
+			uploadedFiles[filepath.Base(path)] = version
 		}
 		return nil
 	})
 	if err != nil {
 		s.logger.Error("failed to read esxi version files", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -364,36 +739,54 @@ func (s *Server) esxiVersionList(w http.ResponseWriter, r *http.Request) {
 		},
 	); err != nil {
 		s.logger.Error("failed to generate response", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 }
 
-func (s *Server) getInstaller(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getInstaller(rw http.ResponseWriter, r *http.Request) {
 	bootFilePath := mux.Vars(r)["path"]
 	filename := filepath.Base(bootFilePath)
+	w := &countingResponseWriter{ResponseWriter: rw}
+	defer func() {
+		installerBytes.WithLabelValues(filename).Add(float64(w.written))
+	}()
+	clientMac, registered := s.clientMac(r)
 	var fullBootFilePath string
+	var phase common.Phase
 	switch filename {
 	case "mboot.efi":
 		common.MbootMutex.RLock()
 		defer common.MbootMutex.RUnlock()
 		fullBootFilePath = filepath.Join(s.FileRootDirInfo.BootFileDirPath, filename)
+		phase = common.PhaseBootloader
 	case "boot.cfg":
 		fullBootFilePath = filepath.Join(s.FileRootDirInfo.BootFileDirPath, bootFilePath)
-		tmpl, err := template.ParseFiles(fullBootFilePath)
+		tmpl, err := common.ParseBootCfgTemplate(fullBootFilePath)
 		if err != nil {
 			s.logger.Error("error opening file", zap.Error(err))
-			http.Error(w, "file not found", http.StatusNotFound)
+			if registered {
+				s.fail(clientMac, err)
+			}
+			writeError(w, r, http.StatusNotFound, "file not found")
 			return
 		}
 		dir := filepath.Dir(bootFilePath)
-		data := common.LoadBootCfgTemplateData(s.cfg.ServicePortAddr.String(), strconv.Itoa(s.cfg.APIServerPort), dir)
+		ksPath, err := common.KSPath(s.store, s.cfg, clientMac)
+		if err != nil {
+			s.logger.Error("failed to issue ks token", zap.Error(err))
+		}
+		data := common.LoadBootCfgTemplateData(config.InstallerScheme(s.cfg), s.cfg.ServicePortAddr.String(), strconv.Itoa(s.cfg.BootServerPort), dir, ksPath)
 		var buf bytes.Buffer
 		err = tmpl.Execute(&buf, data)
 		if err != nil {
 			s.logger.Error("failed to update boot file template", zap.Error(err))
 		}
 		http.ServeContent(w, r, "boot.cfg", time.Now(), bytes.NewReader(buf.Bytes()))
+		if registered && r.Method == "GET" {
+			s.transition(clientMac, common.PhaseBootCfg)
+		}
+		s.publishInstallerFileServed(r, clientMac, bootFilePath)
 		return
 	default:
 		fullBootFilePath = filepath.Join(s.FileRootDirInfo.BootFileDirPath, bootFilePath)
@@ -401,47 +794,145 @@ func (s *Server) getInstaller(w http.ResponseWriter, r *http.Request) {
 	file, err := os.Open(fullBootFilePath)
 	if err != nil {
 		s.logger.Error("error opening file", zap.Error(err))
-		http.Error(w, "file not found", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, "file not found")
 		return
 	}
 	file.Close()
 	http.ServeFile(w, r, fullBootFilePath)
+	if registered && phase != "" && r.Method == "GET" {
+		s.transition(clientMac, phase)
+	}
+	s.publishInstallerFileServed(r, clientMac, bootFilePath)
 }
 
-func initializeKsDir(dirPath string) (string, error) {
+// initializeKsDir keeps the ks.cfg files of registered hosts and removes the ones left behind by others.
+func initializeKsDir(dirPath string, store *common.Store) (string, error) {
 	ksDirPath := filepath.Join(dirPath, "ks")
-	err := os.RemoveAll(ksDirPath)
+	err := os.MkdirAll(ksDirPath, 0755)
 	if err != nil {
-		return "", fmt.Errorf("failed to remove directory: %w", err)
+		return "", fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	err = os.Mkdir(ksDirPath, 0755)
+	entries, err := os.ReadDir(ksDirPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create directory: %w", err)
+		return "", fmt.Errorf("failed to read directory: %w", err)
+	}
+	for _, entry := range entries {
+		mac := strings.Replace(entry.Name(), "-", ":", -1)
+		if _, found := store.Get(mac); found && entry.IsDir() {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(ksDirPath, entry.Name()))
+		if err != nil {
+			return "", fmt.Errorf("failed to remove directory: %w", err)
+		}
 	}
 
 	return ksDirPath, nil
 }
 
+// hashStoredPasswords replaces the plaintext root passwords of registrations made before passwords were hashed,
+// renders their ks.cfg again and compacts the journal, so that the plaintext passwords are gone from disk.
+func (s *Server) hashStoredPasswords() error {
+	hashed := 0
+	for _, reg := range s.store.List() {
+		ks, err := registrationKS(reg)
+		if err != nil {
+			return err
+		}
+		if ks == nil || common.IsSHA512Crypt(ks.Password) {
+			continue
+		}
+		if err := ks.hashPassword(); err != nil {
+			return err
+		}
+		payload, err := json.Marshal(ks)
+		if err != nil {
+			return err
+		}
+		err = s.store.Update(reg.Macaddress, func(reg *common.Registration) error {
+			reg.KS = payload
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.writeKsConfig(*ks); err != nil {
+			return err
+		}
+		s.logger.Info(fmt.Sprintf("hashed the root password of MAC %s", reg.Macaddress))
+		hashed++
+	}
+	if hashed == 0 {
+		return nil
+	}
+	return s.store.Compact()
+}
+
 func (s *Server) ksHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		s.getKsConfig(w, r)
+		s.listRegistrations(w, r)
 	case "POST":
 		s.createKsConfig(w, r)
 	default:
 		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
+
+// bootKsHandler serves installing hosts their ks.cfg on the boot listener.
+func (s *Server) bootKsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.getKsConfig(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 	}
 }
 
 func (s *Server) ksIDHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
+	case "GET":
+		s.getRegistration(w, r)
+	case "PUT", "PATCH":
+		s.updateKsConfig(w, r)
 	case "DELETE":
 		s.deleteKsConfig(w, r)
 	default:
 		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
+
+func (s *Server) ksTokenHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		s.resetKsToken(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
+
+func (s *Server) ksCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "POST":
+		s.completeKsConfig(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
+
+func (s *Server) ksStatusHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.getKsStatus(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 	}
 }
 
@@ -451,7 +942,7 @@ func (s *Server) getInstallerHandler(w http.ResponseWriter, r *http.Request) {
 		s.getInstaller(w, r)
 	default:
 		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 	}
 }
 
@@ -461,23 +952,63 @@ func (s *Server) esxiVersionListHandler(w http.ResponseWriter, r *http.Request)
 		s.esxiVersionList(w, r)
 	default:
 		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 	}
 }
 
-func RunServer(ctx context.Context, cfg *config.Config, logger *zap.Logger, fileRootDirInfo *config.FileRootDirInfo) {
-	newKsDirPath, err := initializeKsDir(cfg.KsDirPath)
+// registerAPIRoutes registers the management API on r.
+func (s *Server) registerAPIRoutes(r *mux.Router) {
+	limit := s.cfg.MaxRequestBodySize
+	r.HandleFunc("/upload", s.limitBody(s.cfg.MaxUploadSize, s.audit(s.getUploadFileHandler(s.cfg))))
+	r.HandleFunc("/ks", s.limitBody(limit, s.audit(s.ksHandler)))
+	r.HandleFunc("/ks/bulk", s.limitBody(s.cfg.MaxBulkBodySize, s.audit(s.ksBulkHandler)))
+	r.HandleFunc("/ks/preview", s.limitBody(limit, s.ksPreviewHandler))
+	r.HandleFunc("/ks/{id}", s.limitBody(limit, s.audit(s.ksIDHandler)))
+	r.HandleFunc("/ks/{id}/status", s.limitBody(limit, s.ksStatusHandler))
+	r.HandleFunc("/ks/{id}/ks-token", s.limitBody(limit, s.audit(s.ksTokenHandler)))
+	r.HandleFunc("/esxi-versions", s.limitBody(limit, s.esxiVersionListHandler))
+	r.HandleFunc("/events", s.limitBody(limit, s.eventStreamHandler))
+	r.HandleFunc("/audit", s.limitBody(limit, s.auditHandler))
+}
+
+func RunServer(ctx context.Context, cfg *config.Config, logger *zap.Logger, fileRootDirInfo *config.FileRootDirInfo, store *common.Store, events *common.EventBus) {
+	newKsDirPath, err := initializeKsDir(cfg.KsDirPath, store)
 	if err != nil {
 		logger.Error("error initializing KS directory", zap.Error(err))
 		return
 	}
+	auditor, err := NewAuditor(filepath.Join(cfg.FileDirPath, "audit.log"))
+	if err != nil {
+		logger.Error("error opening audit log", zap.Error(err))
+		return
+	}
+	auth, err := loadAuthenticator(cfg, logger)
+	if err != nil {
+		logger.Error("error loading auth config", zap.Error(err))
+		return
+	}
 	dhcpCfg := config.GetDHCPLeaseConfig(cfg)
+	registerStoreMetrics(store, dhcpCfg)
 	srv := &Server{
 		KSDirPath:       newKsDirPath,
 		DHCPLeaseConfig: dhcpCfg,
 		FileRootDirInfo: fileRootDirInfo,
 		logger:          logger,
 		cfg:             cfg,
+		store:           store,
+		events:          events,
+		auditor:         auditor,
+		auth:            auth,
+	}
+	if cfg.RateLimit > 0 {
+		srv.limiter = newRateLimiter(cfg.RateLimit, cfg.RateLimitBurst)
+	}
+	if cfg.MaxConcurrentUploads > 0 {
+		srv.uploadSlots = make(chan struct{}, cfg.MaxConcurrentUploads)
+	}
+	if err := srv.hashStoredPasswords(); err != nil {
+		logger.Error("error hashing stored passwords", zap.Error(err))
+		return
 	}
 	select {
 	case <-ctx.Done():
@@ -486,18 +1017,69 @@ func RunServer(ctx context.Context, cfg *config.Config, logger *zap.Logger, file
 	default:
 	}
 
-	logger.Info("starting API server...")
+	var tlsCfg *tls.Config
+	if cfg.TLSEnabled {
+		tlsCfg, err = loadTLSConfig(cfg, logger)
+		if err != nil {
+			logger.Error("error loading TLS certificate", zap.Error(err))
+			return
+		}
+	}
+	boot := &http.Server{
+		Addr:      net.JoinHostPort(cfg.ServicePortAddr.String(), strconv.Itoa(cfg.BootServerPort)),
+		Handler:   srv.bootRouter(),
+		TLSConfig: tlsCfg,
+	}
+	management := &http.Server{
+		Addr:      net.JoinHostPort(cfg.APIPortAddr.String(), strconv.Itoa(cfg.APIServerPort)),
+		Handler:   srv.managementRouter(),
+		TLSConfig: tlsCfg,
+	}
+	go srv.listenAndServe("boot", boot)
+	srv.listenAndServe("management", management)
+}
 
+// managementRouter routes the management API and the upload form, served on the API port.
+func (s *Server) managementRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(s.rateLimit, s.authorize)
 
-	r.HandleFunc("/", srv.uploadForm())
-	r.HandleFunc("/upload", srv.getUploadFileHandler(cfg))
-	r.HandleFunc("/ks", srv.ksHandler)
-	r.HandleFunc("/ks/{id}", srv.ksIDHandler)
-	r.HandleFunc("/esxi-versions", srv.esxiVersionListHandler)
-	r.HandleFunc("/installer/{path:.*}", srv.getInstallerHandler)
+	r.HandleFunc("/", s.uploadForm())
+	r.Handle("/metrics", promhttp.Handler())
+	r.HandleFunc("/ca.crt", s.caCertHandler)
+	// The unversioned routes are kept as aliases of the versioned API for existing clients.
+	s.registerAPIRoutes(r)
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.APIServerPort), r); err != nil {
-		logger.Panic("shutting down API server...", zap.Error(err))
+	v1 := r.PathPrefix(apiPrefix).Subrouter()
+	s.registerAPIRoutes(v1)
+	v1.HandleFunc("/openapi.yaml", s.openAPIHandler)
+	v1.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, "resource not found")
+	})
+	return r
+}
+
+// bootRouter routes what installing hosts fetch, served on the service port.
+// Nothing else is reachable from the service network.
+func (s *Server) bootRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/installer/{path:.*}", s.getInstallerHandler)
+	r.HandleFunc("/ks", s.bootKsHandler)
+	r.HandleFunc("/ks/{token}", s.bootKsHandler)
+	r.HandleFunc("/ks/{id}/complete", s.ksCompleteHandler)
+	r.HandleFunc("/ks/{id}/complete/{token}", s.ksCompleteHandler)
+	return r
+}
+
+func (s *Server) listenAndServe(name string, server *http.Server) {
+	s.logger.Info(fmt.Sprintf("starting %s listener on %s...", name, server.Addr))
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		s.logger.Panic(fmt.Sprintf("shutting down %s listener...", name), zap.Error(err))
 	}
 }
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"kickstart/common"
+	"kickstart/config"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const testISO = "VMware-VMvisor-Installer-8.0U1-21495797.x86_64.iso"
+
+// newTestServer returns a server keeping its files in a temporary directory, with testISO uploaded.
+// Its DHCP range holds no IP, since finding a free one needs the service port.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := common.NewStore(filepath.Join(dir, "registrations.journal"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	auditor, err := NewAuditor(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("NewAuditor() error = %v", err)
+	}
+	s := &Server{
+		KSDirPath: filepath.Join(dir, "ks"),
+		DHCPLeaseConfig: &config.DHCPLeaseConfig{
+			DHCPStartIP: net.ParseIP("172.16.0.2"),
+			DHCPEndIP:   net.ParseIP("172.16.0.1"),
+		},
+		FileRootDirInfo: &config.FileRootDirInfo{
+			BootFileDirPath:    filepath.Join(dir, "bootfiles"),
+			UploadedISODirPath: filepath.Join(dir, "isofiles"),
+		},
+		logger: zap.NewNop(),
+		cfg: &config.Config{
+			ServicePortAddr:    net.ParseIP("172.16.0.1"),
+			BootServerPort:     80,
+			MaxRequestBodySize: 1024 * 1024,
+			MaxBulkBodySize:    1024 * 1024,
+		},
+		store:   store,
+		events:  common.NewEventBus(store),
+		auditor: auditor,
+	}
+	addTestISO(t, s, testISO, "8.0.1")
+	if err := os.MkdirAll(s.KSDirPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// addTestISO writes the files of an extracted ISO of ESXi version that the API reads.
+func addTestISO(t *testing.T, s *Server, name, version string) {
+	t.Helper()
+	isoDir := filepath.Join(s.FileRootDirInfo.BootFileDirPath, name)
+	if err := os.MkdirAll(filepath.Join(isoDir, "esxi", "upgrade"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(isoDir, "boot.cfg"), []byte("kernelopt=runweasel\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metadata := "<vum><product><esxVersion>" + version + "</esxVersion></product></vum>"
+	if err := os.WriteFile(filepath.Join(isoDir, "esxi", "upgrade", "metadata.xml"), []byte(metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashStoredPasswords(t *testing.T) {
+	s := newTestServer(t)
+	const password = "VMware1!"
+	plain := KS{Macaddress: "00:50:56:aa:bb:01", Password: password, IP: "172.16.0.11", Netmask: "255.255.255.0",
+		Gateway: "172.16.0.254", Nameserver: "172.16.0.254", Hostname: "esxi01", ISOFilename: testISO}
+	payload, err := json.Marshal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A registration made before passwords were hashed, changed again afterwards.
+	for i := 0; i < 2; i++ {
+		err = s.store.Upsert(plain.Macaddress, func(reg *common.Registration) error {
+			reg.KS = payload
+			reg.Hostname = plain.Hostname
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.hashStoredPasswords(); err != nil {
+		t.Fatalf("hashStoredPasswords() error = %v", err)
+	}
+	reg, _ := s.store.Get(plain.Macaddress)
+	ks, err := registrationKS(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !common.VerifyPassword(password, ks.Password) {
+		t.Errorf("stored password = %s, want a hash of %s", ks.Password, password)
+	}
+	journal, err := os.ReadFile(filepath.Join(filepath.Dir(s.KSDirPath), "registrations.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(journal, []byte(password)) {
+		t.Errorf("journal still holds the plaintext password:\n%s", journal)
+	}
+	kscfg, err := os.ReadFile(s.ksFilePath(plain.Macaddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(kscfg, []byte(password)) {
+		t.Errorf("ks.cfg still holds the plaintext password:\n%s", kscfg)
+	}
+}
@@ -0,0 +1,308 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kickstart/common"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// maxAuditedBodySize is how much of a request body is read to summarize its JSON payload.
+const maxAuditedBodySize = 64 * 1024
+
+type AuditEntry struct {
+	Time       time.Time   `json:"time"`
+	Action     string      `json:"action"`
+	RemoteAddr string      `json:"remote_addr"`
+	Identity   string      `json:"identity,omitempty"`
+	Target     string      `json:"target,omitempty"`
+	Payload    interface{} `json:"payload,omitempty"`
+	Status     int         `json:"status"`
+	Result     string      `json:"result"`
+}
+
+type AuditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// Auditor keeps an append-only trail of the state-changing API calls.
+type Auditor struct {
+	mu      sync.Mutex
+	journal *common.Journal
+}
+
+func NewAuditor(path string) (*Auditor, error) {
+	journal, err := common.OpenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Auditor{journal: journal}, nil
+}
+
+func (a *Auditor) Record(entry AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.journal.Append(entry)
+}
+
+// Entries returns the recorded entries that match filter, oldest first.
+func (a *Auditor) Entries(filter func(entry AuditEntry) bool) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries := []AuditEntry{}
+	err := a.journal.Replay(func(data json.RawMessage) error {
+		var entry AuditEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to decode audit entry: %w", err)
+		}
+		if filter(entry) {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+type identityContextKey struct{}
+
+// requestIdentity returns who sent r if the request was authenticated.
+func requestIdentity(r *http.Request) string {
+	identity, _ := r.Context().Value(identityContextKey{}).(string)
+	return identity
+}
+
+// statusRecorder remembers the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// redactJSON decodes body and masks the values of password-like fields and secret CLI commands.
+func redactJSON(body []byte) interface{} {
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+	return redactValue(payload)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redactSecretCLI(v)
+		for key, child := range v {
+			if key != secretCLIKey && common.IsSecretKey(key) {
+				v[key] = common.RedactedValue
+				continue
+			}
+			v[key] = redactValue(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactValue(child)
+		}
+	case string:
+		return common.RedactString(v)
+	}
+	return value
+}
+
+// redactSecretCLI masks the commands of a decoded KS that secretcli marks as secret.
+func redactSecretCLI(ks map[string]interface{}) {
+	cli, _ := ks["cli"].([]interface{})
+	indexes, _ := ks[secretCLIKey].([]interface{})
+	for _, index := range indexes {
+		i, ok := index.(float64)
+		if ok && i >= 0 && int(i) < len(cli) {
+			cli[int(i)] = common.RedactedValue
+		}
+	}
+}
+
+// errorReader fails every read with err.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// audit records the state-changing calls handled by next, that is everything but GET and HEAD.
+func (s *Server) audit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			next(w, r)
+			return
+		}
+
+		var payload interface{}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditedBodySize))
+			rest := io.Reader(r.Body)
+			if err != nil {
+				// The handler gets what was read and then the same error, as it would have without the audit.
+				rest = errorReader{err}
+			} else {
+				payload = redactJSON(body)
+			}
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), rest))
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		entry := AuditEntry{
+			Time:       time.Now(),
+			Action:     auditAction(r),
+			RemoteAddr: r.RemoteAddr,
+			Identity:   requestIdentity(r),
+			Target:     auditTarget(r, payload),
+			Payload:    payload,
+			Status:     recorder.status,
+			Result:     "success",
+		}
+		if recorder.status >= 400 {
+			entry.Result = "failure"
+		}
+		if r.MultipartForm != nil {
+			files := []map[string]interface{}{}
+			for _, headers := range r.MultipartForm.File {
+				for _, header := range headers {
+					files = append(files, map[string]interface{}{"filename": header.Filename, "size": header.Size})
+				}
+			}
+			entry.Payload = map[string]interface{}{"files": files}
+		}
+
+		err := s.auditor.Record(entry)
+		if err != nil {
+			s.logger.Error("failed to record audit entry", zap.Error(err))
+		}
+	}
+}
+
+// auditAction names the call r by its method and route, such as DELETE /ks/{id}.
+func auditAction(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return r.Method + " " + template
+		}
+	}
+	return r.Method + " " + r.URL.Path
+}
+
+// auditTarget returns the MAC address or file the call acted on.
+func auditTarget(r *http.Request, payload interface{}) string {
+	if id := mux.Vars(r)["id"]; id != "" {
+		return macFromID(id)
+	}
+	if fields, ok := payload.(map[string]interface{}); ok {
+		if mac, ok := fields["macaddress"].(string); ok {
+			return mac
+		}
+	}
+	if r.MultipartForm != nil {
+		for _, headers := range r.MultipartForm.File {
+			for _, header := range headers {
+				return header.Filename
+			}
+		}
+	}
+	return ""
+}
+
+// getAuditEntries returns the audit trail, narrowed down by the action, target, identity, remote and since query parameters.
+// The limit query parameter keeps only the most recent entries.
+func (s *Server) getAuditEntries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			writeError(w, r, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+	}
+	target := strings.ToLower(strings.Replace(query.Get("target"), "-", ":", -1))
+	remote := query.Get("remote")
+
+	entries, err := s.auditor.Entries(func(entry AuditEntry) bool {
+		if value := query.Get("action"); value != "" && !strings.EqualFold(entry.Action, value) {
+			return false
+		}
+		if target != "" && strings.ToLower(entry.Target) != target {
+			return false
+		}
+		if value := query.Get("identity"); value != "" && entry.Identity != value {
+			return false
+		}
+		if remote != "" {
+			host, _, err := net.SplitHostPort(entry.RemoteAddr)
+			if err != nil || host != remote {
+				return false
+			}
+		}
+		return since.IsZero() || !entry.Time.Before(since)
+	})
+	if err != nil {
+		s.logger.Error("failed to read audit entries", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(AuditResponse{Entries: entries}); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.getAuditEntries(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAuditKeepsRequestBody(t *testing.T) {
+	body := `{"macaddress":"00:50:56:aa:bb:01","password":"VMware1!"}`
+	large := `{"hostname":"` + strings.Repeat("a", maxAuditedBodySize) + `"}`
+	failure := errors.New("connection reset")
+	tests := []struct {
+		name     string
+		body     io.Reader
+		wantBody string
+		wantErr  error
+	}{
+		{name: "whole body", body: strings.NewReader(body), wantBody: body},
+		{name: "body larger than what is audited", body: strings.NewReader(large), wantBody: large},
+		{
+			name:     "read error",
+			body:     io.MultiReader(strings.NewReader(body[:20]), iotest.ErrReader(failure)),
+			wantBody: body[:20],
+			wantErr:  failure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			var got []byte
+			var gotErr error
+			handler := s.audit(func(w http.ResponseWriter, r *http.Request) {
+				got, gotErr = io.ReadAll(r.Body)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/ks", tt.body)
+			req.Header.Set("Content-Type", "application/json")
+			handler(httptest.NewRecorder(), req)
+
+			if !bytes.Equal(got, []byte(tt.wantBody)) {
+				t.Errorf("handler read %d bytes, want %d", len(got), len(tt.wantBody))
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("handler read error = %v, want %v", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"kickstart/config"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+var roleLevels = map[string]int{
+	config.RoleReadOnly: 1,
+	config.RoleOperator: 2,
+	config.RoleAdmin:    3,
+}
+
+type credential struct {
+	name string
+	role string
+	// hash is the SHA-256 hash of the password or token.
+	hash []byte
+}
+
+// authenticator checks the credentials of API requests against the users and tokens of AUTH_CONFIG_PATH.
+type authenticator struct {
+	users  map[string]credential
+	tokens []credential
+}
+
+func newAuthenticator(cfg *config.AuthConfig) (*authenticator, error) {
+	a := &authenticator{users: make(map[string]credential)}
+	for _, user := range cfg.Users {
+		hash := sha256.Sum256([]byte(user.Password))
+		c := credential{name: user.Username, role: user.Role, hash: hash[:]}
+		if user.PasswordSHA256 != "" {
+			decoded, err := hex.DecodeString(user.PasswordSHA256)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("password_sha256 of user %s is not a hex encoded SHA-256 hash", user.Username)
+			}
+			c.hash = decoded
+		}
+		a.users[user.Username] = c
+	}
+	for _, token := range cfg.Tokens {
+		hash := sha256.Sum256([]byte(token.Token))
+		a.tokens = append(a.tokens, credential{name: "token:" + token.Name, role: token.Role, hash: hash[:]})
+	}
+	return a, nil
+}
+
+// authenticate returns who sent r and their role, taken from a bearer token or basic auth.
+func (a *authenticator) authenticate(r *http.Request) (credential, bool) {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		hash := sha256.Sum256([]byte(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))))
+		for _, c := range a.tokens {
+			if subtle.ConstantTimeCompare(hash[:], c.hash) == 1 {
+				return c, true
+			}
+		}
+		return credential{}, false
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return credential{}, false
+	}
+	c, found := a.users[username]
+	hash := sha256.Sum256([]byte(password))
+	if !found || subtle.ConstantTimeCompare(hash[:], c.hash) != 1 {
+		return credential{}, false
+	}
+	return c, true
+}
+
+// requiredRole returns the role needed to be served r, or an empty string for the paths that installed hosts and monitoring use.
+func (s *Server) requiredRole(r *http.Request) string {
+	template := ""
+	if route := mux.CurrentRoute(r); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+	template = strings.TrimPrefix(template, apiPrefix)
+	switch template {
+	case "/metrics", "/openapi.yaml", "/ca.crt":
+		return ""
+	case "/ks/preview":
+		// Previews change nothing.
+		return config.RoleReadOnly
+	case "/upload", "/audit":
+		// Uploads can replace the mboot.efi shared by every host.
+		return config.RoleAdmin
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return config.RoleReadOnly
+	}
+	return config.RoleOperator
+}
+
+// authorize is a middleware rejecting the requests whose sender lacks the role required for them.
+// Every request is let through when AUTH_CONFIG_PATH is not set.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := s.requiredRole(r)
+		if s.auth == nil || role == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c, ok := s.auth.authenticate(r)
+		if !ok {
+			s.logger.Warn(fmt.Sprintf("unauthenticated %s request to %s from %s", r.Method, r.URL.Path, r.RemoteAddr))
+			w.Header().Set("WWW-Authenticate", `Basic realm="kickstart"`)
+			writeError(w, r, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if roleLevels[c.role] < roleLevels[role] {
+			s.logger.Warn(fmt.Sprintf("%s with %s role was denied %s request to %s", c.name, c.role, r.Method, r.URL.Path))
+			writeError(w, r, http.StatusForbidden, fmt.Sprintf("%s role is required", role))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, c.name)))
+	})
+}
+
+func loadAuthenticator(cfg *config.Config, logger *zap.Logger) (*authenticator, error) {
+	if cfg.AuthConfigPath == "" {
+		logger.Warn("AUTH_CONFIG_PATH is not set, the management API is open to anyone")
+		return nil, nil
+	}
+	authCfg, err := config.LoadAuthConfig(cfg.AuthConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return newAuthenticator(authCfg)
+}
@@ -0,0 +1,348 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kickstart/common"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// csvColumns are the columns a CSV import can have, named after the keys of the registration request.
+var csvColumns = map[string]bool{
+	"macaddress":    true,
+	"password":      true,
+	"ip":            true,
+	"netmask":       true,
+	"gateway":       true,
+	"nameserver":    true,
+	"hostname":      true,
+	"vlanid":        true,
+	"keyboard":      true,
+	"isofilename":   true,
+	"cli":           true,
+	"secretcli":     true,
+	"notvmpgcreate": true,
+	"secureboot":    true,
+}
+
+type BulkResult struct {
+	Row        int               `json:"row"`
+	Macaddress string            `json:"macaddress,omitempty"`
+	IP         string            `json:"ip,omitempty"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+type BulkResponse struct {
+	Registered int          `json:"registered"`
+	Results    []BulkResult `json:"results"`
+}
+
+// parseCSVRow builds a registration request from one CSV record.
+// The cli column holds the commands separated by semicolons.
+func parseCSVRow(header, record []string) (KS, error) {
+	var ks KS
+	for i, column := range header {
+		value := strings.TrimSpace(record[i])
+		if value == "" {
+			continue
+		}
+		switch column {
+		case "macaddress":
+			ks.Macaddress = value
+		case "password":
+			ks.Password = value
+		case "ip":
+			ks.IP = value
+		case "netmask":
+			ks.Netmask = value
+		case "gateway":
+			ks.Gateway = value
+		case "nameserver":
+			ks.Nameserver = value
+		case "hostname":
+			ks.Hostname = value
+		case "vlanid":
+			vlanID, err := strconv.Atoi(value)
+			if err != nil {
+				return ks, fmt.Errorf("vlanid: must be an integer")
+			}
+			ks.VLANID = &vlanID
+		case "keyboard":
+			ks.Keyboard = value
+		case "isofilename":
+			ks.ISOFilename = value
+		case "cli":
+			for _, command := range strings.Split(value, ";") {
+				if command = strings.TrimSpace(command); command != "" {
+					ks.CLI = append(ks.CLI, command)
+				}
+			}
+		case "secretcli":
+			for _, index := range strings.Split(value, ";") {
+				if index = strings.TrimSpace(index); index == "" {
+					continue
+				}
+				i, err := strconv.Atoi(index)
+				if err != nil {
+					return ks, fmt.Errorf("secretcli: must be indexes of cli commands separated by ;")
+				}
+				ks.SecretCLI = append(ks.SecretCLI, i)
+			}
+		case "notvmpgcreate":
+			notVmPgCreate, err := strconv.ParseBool(value)
+			if err != nil {
+				return ks, fmt.Errorf("notvmpgcreate: must be true or false")
+			}
+			ks.NotVmPgCreate = notVmPgCreate
+		case "secureboot":
+			secureBoot, err := strconv.ParseBool(value)
+			if err != nil {
+				return ks, fmt.Errorf("secureboot: must be true or false")
+			}
+			ks.SecureBoot = secureBoot
+		}
+	}
+	return ks, nil
+}
+
+// readBulkRows decodes the registration requests of a bulk registration.
+// Rows that cannot be decoded are returned with their error so they can be reported with the others.
+func readBulkRows(r *http.Request) ([]KS, []error, error) {
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		var rows []json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&rows); err != nil {
+			return nil, nil, fmt.Errorf("body must be a JSON array of registrations: %w", err)
+		}
+		kss := make([]KS, len(rows))
+		errs := make([]error, len(rows))
+		for i, row := range rows {
+			errs[i] = json.Unmarshal(row, &kss[i])
+		}
+		return kss, errs, nil
+	case strings.HasPrefix(contentType, "text/csv"):
+		return readCSVRows(r.Body)
+	case strings.HasPrefix(contentType, "multipart/form-data"):
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, nil, fmt.Errorf("error retrieving the file: %w", err)
+		}
+		defer file.Close()
+		return readCSVRows(file)
+	}
+	return nil, nil, errUnsupportedContentType
+}
+
+var errUnsupportedContentType = errors.New("invalid Content-Type")
+
+func readCSVRows(reader io.Reader) ([]KS, []error, error) {
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV format: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil, errors.New("CSV must have a header row")
+	}
+	header := records[0]
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(column))
+		if !csvColumns[header[i]] {
+			return nil, nil, fmt.Errorf("unknown CSV column %q", column)
+		}
+	}
+	kss := make([]KS, len(records)-1)
+	errs := make([]error, len(records)-1)
+	for i, record := range records[1:] {
+		kss[i], errs[i] = parseCSVRow(header, record)
+	}
+	return kss, errs, nil
+}
+
+// createKsConfigs registers every host of a JSON array or CSV file.
+// All rows are validated before any of them is registered, and PXE IPs are assigned to the whole batch at once,
+// so the batch is either registered completely or not at all.
+func (s *Server) createKsConfigs(w http.ResponseWriter, r *http.Request) {
+	kss, rowErrs, err := readBulkRows(r)
+	if err != nil {
+		s.logger.Error("could not read bulk registration", zap.Error(err))
+		if err == errUnsupportedContentType {
+			writeError(w, r, http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w, r, s.cfg.MaxBulkBodySize)
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(kss) == 0 {
+		writeError(w, r, http.StatusBadRequest, "no registrations given")
+		return
+	}
+
+	common.RegistrationMutex.Lock()
+	defer common.RegistrationMutex.Unlock()
+
+	results := make([]BulkResult, len(kss))
+	rows := make(map[string]int)
+	hosts := registeredHosts(s.store.List())
+	failed := false
+	for i := range kss {
+		kss[i].Macaddress = strings.ToLower(kss[i].Macaddress)
+		ks := kss[i]
+		result := BulkResult{Row: i + 1, Macaddress: ks.Macaddress, Status: "valid"}
+		err := rowErrs[i]
+		if err == nil {
+			err = ks.Validate()
+		}
+		if err == nil {
+			err = s.validateISO(ks)
+		}
+		if err == nil {
+			if row, ok := rows[ks.Macaddress]; ok {
+				err = fmt.Errorf("macaddress is already used by row %d", row)
+			}
+			rows[ks.Macaddress] = i + 1
+		}
+		if err == nil {
+			conflicts := s.registrationConflicts(ks, hosts)
+			if conflict := s.reregistrationConflict(ks); conflict != "" && !forced(r) {
+				conflicts = append(conflicts, conflict)
+			}
+			if len(conflicts) > 0 {
+				err = fmt.Errorf("conflicting registration: %s", strings.Join(conflicts, "; "))
+			}
+			hosts = append(hosts, registeredHost{
+				macaddress: ks.Macaddress,
+				hostname:   ks.Hostname,
+				ip:         ks.IP,
+				source:     fmt.Sprintf("row %d", i+1),
+			})
+		}
+		if err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+			result.Fields = validationFields(err)
+			failed = true
+		}
+		results[i] = result
+	}
+	if failed {
+		s.logger.Error("bulk registration has invalid rows, nothing was registered")
+		s.writeBulkResponse(w, http.StatusBadRequest, BulkResponse{Results: results})
+		return
+	}
+
+	macs := make([]string, len(kss))
+	payloads := make([][]byte, len(kss))
+	completionTokens := make([]string, len(kss))
+	for i := range kss {
+		err = kss[i].hashPassword()
+		if err != nil {
+			s.logger.Error("failed to hash password", zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+			return
+		}
+		macs[i] = kss[i].Macaddress
+		payloads[i], err = json.Marshal(kss[i])
+		if err != nil {
+			s.logger.Error("failed to encode registration", zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+			return
+		}
+		completionTokens[i], err = common.NewToken()
+		if err != nil {
+			s.logger.Error("failed to issue completion token", zap.Error(err))
+			writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+			return
+		}
+	}
+
+	// Every ks.cfg is written before the batch is stored, so that a failure leaves nothing registered.
+	staged := make([]string, 0, len(kss))
+	discardStaged := func() {
+		for _, stagedPath := range staged {
+			os.Remove(stagedPath)
+			// Only removes the directories created for new hosts, which are empty.
+			os.Remove(filepath.Dir(stagedPath))
+		}
+	}
+	for i, ks := range kss {
+		stagedPath, err := s.stageKsConfig(ks, completionTokens[i])
+		if err != nil {
+			s.logger.Error("failed to write ks config file", zap.Error(err))
+			discardStaged()
+			writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+			return
+		}
+		staged = append(staged, stagedPath)
+	}
+
+	err = s.store.AssignIPs(macs, s.DHCPLeaseConfig, func(i int, reg *common.Registration) error {
+		reg.ISOFilename = kss[i].ISOFilename
+		reg.Hostname = kss[i].Hostname
+		reg.KS = payloads[i]
+		reg.CompletionToken = completionTokens[i]
+		return reg.IssueKSToken()
+	})
+	if err != nil {
+		s.logger.Error("error saving bulk registration", zap.Error(err))
+		discardStaged()
+		if err == common.ErrNoAvailableIP {
+			writeError(w, r, http.StatusConflict, "not enough IPs available in the DHCP range for the whole batch")
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+
+	response := BulkResponse{Results: results}
+	for i, ks := range kss {
+		if ip, ok := s.store.IP(ks.Macaddress); ok {
+			response.Results[i].IP = ip.String()
+		}
+		response.Results[i].Status = "registered"
+		response.Registered++
+		err := os.Rename(staged[i], s.ksFilePath(ks.Macaddress))
+		if err != nil {
+			s.logger.Error("failed to put ks config file in place", zap.Error(err))
+			s.fail(ks.Macaddress, err)
+			continue
+		}
+		s.transition(ks.Macaddress, common.PhaseRegistered)
+		s.events.Publish(common.Event{Type: common.EventRegistered, Macaddress: ks.Macaddress})
+	}
+	s.logger.Info(fmt.Sprintf("registered %d hosts in bulk", response.Registered))
+	s.writeBulkResponse(w, http.StatusOK, response)
+}
+
+func (s *Server) writeBulkResponse(w http.ResponseWriter, status int, response BulkResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+	}
+}
+
+func (s *Server) ksBulkHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		s.createKsConfigs(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
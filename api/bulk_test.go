@@ -0,0 +1,159 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCSVRows(t *testing.T) {
+	vlanID := 11
+	tests := []struct {
+		name    string
+		csv     string
+		want    []KS
+		rowErrs []bool
+		wantErr bool
+	}{
+		{
+			name: "every column",
+			csv: "MacAddress,password,ip,netmask,gateway,nameserver,hostname,vlanid,keyboard,isofilename,cli,secretcli,notvmpgcreate,secureboot\n" +
+				"00:50:56:AA:BB:01,VMware1!,192.168.1.1,255.255.255.0,192.168.1.254,192.168.1.250,esxi01,11,US Default,a.iso,vim-cmd hostsvc/enable_ssh; esxcli join --password=x ;,1,true,false\n",
+			want: []KS{{
+				Macaddress:    "00:50:56:AA:BB:01",
+				Password:      "VMware1!",
+				IP:            "192.168.1.1",
+				Netmask:       "255.255.255.0",
+				Gateway:       "192.168.1.254",
+				Nameserver:    "192.168.1.250",
+				Hostname:      "esxi01",
+				VLANID:        &vlanID,
+				Keyboard:      "US Default",
+				ISOFilename:   "a.iso",
+				CLI:           []string{"vim-cmd hostsvc/enable_ssh", "esxcli join --password=x"},
+				SecretCLI:     []int{1},
+				NotVmPgCreate: true,
+			}},
+			rowErrs: []bool{false},
+		},
+		{
+			name:    "empty cells are left unset",
+			csv:     "macaddress,vlanid,cli,secretcli\n00:50:56:aa:bb:01,,,\n",
+			want:    []KS{{Macaddress: "00:50:56:aa:bb:01"}},
+			rowErrs: []bool{false},
+		},
+		{
+			name:    "invalid cells fail their row only",
+			csv:     "macaddress,vlanid,secretcli,secureboot\n00:50:56:aa:bb:01,eleven,,\n00:50:56:aa:bb:02,,,\n00:50:56:aa:bb:03,,first,\n00:50:56:aa:bb:04,,,maybe\n",
+			rowErrs: []bool{true, false, true, true},
+		},
+		{
+			name:    "header only",
+			csv:     "macaddress,ip\n",
+			want:    []KS{},
+			rowErrs: []bool{},
+		},
+		{name: "unknown column", csv: "macaddress,pasword\n00:50:56:aa:bb:01,x\n", wantErr: true},
+		{name: "no header", csv: "", wantErr: true},
+		{name: "rows of different lengths", csv: "macaddress,ip\n00:50:56:aa:bb:01\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kss, errs, err := readCSVRows(strings.NewReader(tt.csv))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readCSVRows() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(errs) != len(tt.rowErrs) {
+				t.Fatalf("readCSVRows() returned %d row errors, want %d", len(errs), len(tt.rowErrs))
+			}
+			for i, rowErr := range errs {
+				if (rowErr != nil) != tt.rowErrs[i] {
+					t.Errorf("row %d error = %v, want error %v", i+1, rowErr, tt.rowErrs[i])
+				}
+			}
+			if tt.want != nil && !reflect.DeepEqual(kss, tt.want) {
+				t.Errorf("readCSVRows() = %+v, want %+v", kss, tt.want)
+			}
+		})
+	}
+}
+
+const bulkHosts = `[
+	{"macaddress":"00:50:56:aa:bb:01","password":"VMware1!","ip":"192.168.1.1","netmask":"255.255.255.0","gateway":"192.168.1.254","nameserver":"192.168.1.250","hostname":"esxi01","isofilename":"` + testISO + `"},
+	{"macaddress":"00:50:56:aa:bb:02","password":"VMware1!","ip":"192.168.1.2","netmask":"255.255.255.0","gateway":"192.168.1.254","nameserver":"192.168.1.250","hostname":"esxi02","isofilename":"` + testISO + `"}
+]`
+
+// TestCreateKsConfigsRegistersNothingOnFailure checks that a batch failing at any step leaves neither registrations nor ks.cfg files behind.
+func TestCreateKsConfigsRegistersNothingOnFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		setup      func(t *testing.T, s *Server)
+		wantStatus int
+	}{
+		{
+			name:       "invalid row",
+			body:       strings.Replace(bulkHosts, `"ip":"192.168.1.2"`, `"ip":"192.168.1"`, 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "duplicate MAC address",
+			body:       strings.Replace(bulkHosts, "00:50:56:aa:bb:02", "00:50:56:aa:bb:01", 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "ks.cfg of a later row cannot be written",
+			body: bulkHosts,
+			setup: func(t *testing.T, s *Server) {
+				// A file where the ks directory of the second host should be.
+				if err := os.WriteFile(filepath.Join(s.KSDirPath, "00-50-56-aa-bb-02"), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "DHCP range too small for the batch",
+			body:       bulkHosts,
+			wantStatus: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			if tt.setup != nil {
+				tt.setup(t, s)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/ks/bulk", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			s.createKsConfigs(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if list := s.store.List(); len(list) != 0 {
+				t.Errorf("store holds %d registrations, want none", len(list))
+			}
+			err := filepath.Walk(s.KSDirPath, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.IsDir() && info.Size() > 0 {
+					t.Errorf("ks file %s is left behind", path)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
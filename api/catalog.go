@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"kickstart/common"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	validation "github.com/go-ozzo/ozzo-validation"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// readEsxiVersion returns the ESXi version of the ISO extracted to isoDir.
+func readEsxiVersion(isoDir string) (string, error) {
+	xmlData, err := os.ReadFile(filepath.Join(isoDir, "esxi", "upgrade", "metadata.xml"))
+	if err != nil {
+		return "", err
+	}
+
+	var vum common.Vum
+	decoder := xml.NewDecoder(bytes.NewReader(xmlData))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	err = decoder.Decode(&vum)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode metadata.xml: %w", err)
+	}
+	return vum.Product.EsxVersion, nil
+}
+
+// isoCatalog returns the ESXi version of every ISO extracted under BootFileDirPath, keyed by ISO filename.
+// Directories that are not extracted ISOs are left out.
+func (s *Server) isoCatalog() (map[string]string, error) {
+	entries, err := os.ReadDir(s.FileRootDirInfo.BootFileDirPath)
+	if err != nil {
+		return nil, err
+	}
+	catalog := make(map[string]string)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		isoDir := filepath.Join(s.FileRootDirInfo.BootFileDirPath, entry.Name())
+		if _, err := os.Stat(filepath.Join(isoDir, "boot.cfg")); err != nil {
+			continue
+		}
+		version, err := readEsxiVersion(isoDir)
+		if err != nil {
+			s.logger.Warn(fmt.Sprintf("failed to read ESXi version of %s", entry.Name()), zap.Error(err))
+			continue
+		}
+		catalog[entry.Name()] = version
+	}
+	return catalog, nil
+}
+
+// latestBootloaderVersion returns the ESXi version that the shared mboot.efi was taken from.
+func (s *Server) latestBootloaderVersion() (*semver.Version, error) {
+	data, err := os.ReadFile(filepath.Join(s.FileRootDirInfo.BootFileDirPath, "latest_release.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var latest common.YamlProduct
+	if err := yaml.Unmarshal(data, &latest); err != nil {
+		return nil, err
+	}
+	return semver.NewVersion(latest.EsxVersion)
+}
+
+// validateISO checks that the ISO requested by ks has been uploaded and can be installed the way ks asks for.
+func (s *Server) validateISO(ks KS) error {
+	catalog, err := s.isoCatalog()
+	if err != nil {
+		return fmt.Errorf("failed to read uploaded ISOs: %w", err)
+	}
+	esxVersion, found := catalog[ks.ISOFilename]
+	if !found {
+		names := make([]string, 0, len(catalog))
+		for name := range catalog {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return validation.Errors{"isofilename": fmt.Errorf("%s has not been uploaded, and no ISO is uploaded yet", ks.ISOFilename)}
+		}
+		return validation.Errors{"isofilename": fmt.Errorf("%s has not been uploaded, uploaded ISOs are %s", ks.ISOFilename, strings.Join(names, ", "))}
+	}
+
+	version, err := semver.NewVersion(esxVersion)
+	if err != nil {
+		return validation.Errors{"isofilename": fmt.Errorf("failed to parse ESXi version %s of %s", esxVersion, ks.ISOFilename)}
+	}
+	if ks.SecureBoot && version.Major() < 7 {
+		// The bootloader of 6.x cannot find boot.cfg with a relative path, so secure boot needs the one of 7.0 or later.
+		bootloader, err := s.latestBootloaderVersion()
+		if err != nil || bootloader.Major() < 7 {
+			return validation.Errors{"isofilename": fmt.Errorf("installing ESXi %s with secure boot needs the bootloader of ESXi 7.0 or later, upload any 7.0 or later ISO first", esxVersion)}
+		}
+	}
+	if ks.SecureBoot && len(ks.CLI) > 0 {
+		return validation.Errors{"cli": errors.New("commands are not run when secure boot is enabled")}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"kickstart/common"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// macFromID returns the MAC address addressed by the {id} path variable, which may separate octets with dashes.
+// MAC addresses are kept in lower case, as the DHCP server sees them.
+func macFromID(id string) string {
+	return strings.ToLower(strings.Replace(id, "-", ":", -1))
+}
+
+// registeredHost is what must stay unique across the registrations.
+type registeredHost struct {
+	macaddress string
+	hostname   string
+	ip         string
+	// source tells where the host comes from in conflict messages.
+	source string
+}
+
+func registeredHosts(regs []common.Registration) []registeredHost {
+	hosts := make([]registeredHost, 0, len(regs))
+	for _, reg := range regs {
+		host := registeredHost{
+			macaddress: reg.Macaddress,
+			hostname:   reg.Hostname,
+			source:     fmt.Sprintf("MAC %s", reg.Macaddress),
+		}
+		if ks, err := registrationKS(reg); err == nil && ks != nil {
+			host.ip = ks.IP
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// registrationConflicts returns why ks cannot be registered along with hosts.
+// The registration of the same MAC address is not a conflict, since ks replaces it.
+func (s *Server) registrationConflicts(ks KS, hosts []registeredHost) []string {
+	var conflicts []string
+	if ip := net.ParseIP(ks.IP); ip != nil && ip.To4() != nil {
+		start := common.IPToInt(s.DHCPLeaseConfig.DHCPStartIP)
+		end := common.IPToInt(s.DHCPLeaseConfig.DHCPEndIP)
+		if n := common.IPToInt(ip); n >= start && n <= end {
+			conflicts = append(conflicts, fmt.Sprintf("ip %s is inside the DHCP range %s-%s", ks.IP, s.DHCPLeaseConfig.DHCPStartIP, s.DHCPLeaseConfig.DHCPEndIP))
+		}
+	}
+	for _, host := range hosts {
+		if host.macaddress == ks.Macaddress {
+			continue
+		}
+		if host.ip != "" && host.ip == ks.IP {
+			conflicts = append(conflicts, fmt.Sprintf("ip %s is already used by %s", ks.IP, host.source))
+		}
+		if host.hostname != "" && strings.EqualFold(host.hostname, ks.Hostname) {
+			conflicts = append(conflicts, fmt.Sprintf("hostname %s is already used by %s", ks.Hostname, host.source))
+		}
+	}
+	return conflicts
+}
+
+// reregistrationConflict reports a MAC address that is already registered with other settings than ks.
+// Registering the very same settings again is allowed.
+func (s *Server) reregistrationConflict(ks KS) string {
+	reg, found := s.store.Get(ks.Macaddress)
+	if !found {
+		return ""
+	}
+	stored, err := registrationKS(reg)
+	if err == nil && stored != nil {
+		// Only the hash of the password is stored, so a matching password counts as the same.
+		if common.VerifyPassword(ks.Password, stored.Password) {
+			ks.Password = stored.Password
+		}
+		if reflect.DeepEqual(stored.normalized(), ks.normalized()) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("macaddress %s is already registered with different settings, use force=true to replace it", ks.Macaddress)
+}
+
+// normalized returns k with empty lists set to nil, as sending "cli": [] or leaving cli out registers the same host.
+func (k KS) normalized() KS {
+	if len(k.CLI) == 0 {
+		k.CLI = nil
+	}
+	if len(k.SecretCLI) == 0 {
+		k.SecretCLI = nil
+	}
+	return k
+}
+
+// forced tells whether the caller asked to replace existing registrations.
+func forced(r *http.Request) bool {
+	return r.URL.Query().Get("force") == "true"
+}
+
+func writeConflicts(w http.ResponseWriter, r *http.Request, conflicts []string) {
+	writeErrorResponse(w, r, http.StatusConflict, ErrorResponse{
+		Message: fmt.Sprintf("conflicting registration: %s", strings.Join(conflicts, "; ")),
+		Details: conflicts,
+	})
+}
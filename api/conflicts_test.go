@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"kickstart/common"
+	"kickstart/config"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRegistrationConflicts(t *testing.T) {
+	s := &Server{DHCPLeaseConfig: &config.DHCPLeaseConfig{
+		DHCPStartIP: net.ParseIP("172.16.0.100"),
+		DHCPEndIP:   net.ParseIP("172.16.0.200"),
+	}}
+	hosts := []registeredHost{
+		{macaddress: "00:50:56:aa:bb:01", hostname: "esxi01", ip: "172.16.0.11", source: "MAC 00:50:56:aa:bb:01"},
+		{macaddress: "00:50:56:aa:bb:02", hostname: "esxi02", ip: "172.16.0.12", source: "row 2"},
+	}
+	tests := []struct {
+		name string
+		ks   KS
+		want []string
+	}{
+		{
+			name: "no conflict",
+			ks:   KS{Macaddress: "00:50:56:aa:bb:03", Hostname: "esxi03", IP: "172.16.0.13"},
+		},
+		{
+			name: "same MAC address replaces its registration",
+			ks:   KS{Macaddress: "00:50:56:aa:bb:01", Hostname: "esxi01", IP: "172.16.0.11"},
+		},
+		{
+			name: "ip of another host",
+			ks:   KS{Macaddress: "00:50:56:aa:bb:03", Hostname: "esxi03", IP: "172.16.0.12"},
+			want: []string{"ip 172.16.0.12 is already used by row 2"},
+		},
+		{
+			name: "hostname of another host in another case",
+			ks:   KS{Macaddress: "00:50:56:aa:bb:03", Hostname: "ESXi01", IP: "172.16.0.13"},
+			want: []string{"hostname ESXi01 is already used by MAC 00:50:56:aa:bb:01"},
+		},
+		{
+			name: "first IP of the DHCP range",
+			ks:   KS{Macaddress: "00:50:56:aa:bb:03", Hostname: "esxi03", IP: "172.16.0.100"},
+			want: []string{"ip 172.16.0.100 is inside the DHCP range 172.16.0.100-172.16.0.200"},
+		},
+		{
+			name: "last IP of the DHCP range",
+			ks:   KS{Macaddress: "00:50:56:aa:bb:03", Hostname: "esxi03", IP: "172.16.0.200"},
+			want: []string{"ip 172.16.0.200 is inside the DHCP range 172.16.0.100-172.16.0.200"},
+		},
+		{
+			name: "invalid IP is left to validation",
+			ks:   KS{Macaddress: "00:50:56:aa:bb:03", Hostname: "esxi03", IP: "172.16.0"},
+		},
+		{
+			name: "several conflicts",
+			ks:   KS{Macaddress: "00:50:56:aa:bb:03", Hostname: "esxi02", IP: "172.16.0.11"},
+			want: []string{
+				"ip 172.16.0.11 is already used by MAC 00:50:56:aa:bb:01",
+				"hostname esxi02 is already used by row 2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.registrationConflicts(tt.ks, hosts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("registrationConflicts() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReregistrationConflict(t *testing.T) {
+	registered := KS{Macaddress: "00:50:56:aa:bb:01", Password: "VMware1!", IP: "172.16.0.11", Hostname: "esxi01", ISOFilename: testISO}
+	tests := []struct {
+		name         string
+		ks           KS
+		wantConflict bool
+	}{
+		{"not registered", KS{Macaddress: "00:50:56:aa:bb:02", Password: "VMware1!"}, false},
+		{"same settings", registered, false},
+		{"empty command lists", func() KS { ks := registered; ks.CLI = []string{}; ks.SecretCLI = []int{}; return ks }(), false},
+		{"other commands", func() KS { ks := registered; ks.CLI = []string{"vim-cmd hostsvc/enable_ssh"}; return ks }(), true},
+		{"other hostname", func() KS { ks := registered; ks.Hostname = "esxi02"; return ks }(), true},
+		{"other password", func() KS { ks := registered; ks.Password = "VMware2!"; return ks }(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			stored := registered
+			if err := stored.hashPassword(); err != nil {
+				t.Fatal(err)
+			}
+			payload, err := json.Marshal(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.store.Upsert(registered.Macaddress, func(reg *common.Registration) error {
+				reg.KS = payload
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.reregistrationConflict(tt.ks); (got != "") != tt.wantConflict {
+				t.Errorf("reregistrationConflict() = %q, want conflict %v", got, tt.wantConflict)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// apiPrefix is where the versioned API is served.
+const apiPrefix = "/api/v1"
+
+// ErrorResponse is the body of the errors returned to JSON clients.
+type ErrorResponse struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Details []string          `json:"details,omitempty"`
+}
+
+// isVersionedAPI tells whether r was sent to the versioned API.
+func isVersionedAPI(r *http.Request) bool {
+	return r.URL.Path == apiPrefix || strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+// wantsJSON tells whether the answer to r should be JSON.
+// The versioned API always answers in JSON, while the unversioned routes do so only for clients accepting JSON.
+func wantsJSON(r *http.Request) bool {
+	return isVersionedAPI(r) || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// errorCode turns a status code into the code of an ErrorResponse, such as not_found.
+func errorCode(status int) string {
+	return strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, response ErrorResponse) {
+	if !wantsJSON(r) {
+		http.Error(w, response.Message, status)
+		return
+	}
+	response.Code = errorCode(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeError answers r with an error, as JSON or plain text depending on what the client wants.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeErrorResponse(w, r, status, ErrorResponse{Message: message})
+}
+
+// writeValidationError answers r with 400 Bad Request, reporting the error of each field when err comes from ozzo-validation.
+func writeValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	writeErrorResponse(w, r, http.StatusBadRequest, ErrorResponse{Message: err.Error(), Fields: validationFields(err)})
+}
+
+// validationFields returns the error of each field reported by ozzo-validation, or nil if err does not come from it.
+func validationFields(err error) map[string]string {
+	errs, ok := err.(validation.Errors)
+	if !ok {
+		return nil
+	}
+	fields := make(map[string]string, len(errs))
+	for field, fieldErr := range errs {
+		if fieldErr != nil {
+			fields[field] = fieldErr.Error()
+		}
+	}
+	return fields
+}
+
+// writeJSON answers r with response encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(response)
+}
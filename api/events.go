@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"kickstart/common"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// eventKeepAliveInterval keeps idle event streams from being closed by proxies.
+const eventKeepAliveInterval = 30 * time.Second
+
+func (s *Server) publishInstallerFileServed(r *http.Request, mac, path string) {
+	if r.Method != "GET" {
+		return
+	}
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	s.events.Publish(common.Event{Type: common.EventInstallerFileServed, Macaddress: mac, IP: clientIP, File: path})
+}
+
+// eventFilter selects the events of the hosts given by the mac and hostname query parameters.
+type eventFilter struct {
+	mac      string
+	hostname string
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	query := r.URL.Query()
+	return eventFilter{
+		mac:      strings.ToLower(strings.Replace(query.Get("mac"), "-", ":", -1)),
+		hostname: strings.ToLower(query.Get("hostname")),
+	}
+}
+
+func (f eventFilter) match(event common.Event) bool {
+	if f.mac != "" && strings.ToLower(event.Macaddress) != f.mac {
+		return false
+	}
+	if f.hostname != "" && strings.ToLower(event.Hostname) != f.hostname {
+		return false
+	}
+	return true
+}
+
+// streamEvents sends DHCP, TFTP and installer events to the client as Server-Sent Events until it disconnects.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.logger.Error("streaming is not supported by the response writer")
+		writeError(w, r, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	filter := newEventFilter(r)
+
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			if !filter.match(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				s.logger.Error("failed to encode event", zap.Error(err))
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.streamEvents(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
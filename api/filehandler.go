@@ -114,6 +114,10 @@ func bootLoaderValidation(esxiInfo *common.YamlProduct, currentEsxiInfoFilePath
 func (s *Server) ExtractISOfiles(config *config.Config, esxiFilePath, filename string) (err error) {
 	common.IsoFileUploadMutex.Lock()
 	defer common.IsoFileUploadMutex.Unlock()
+	start := time.Now()
+	defer func() {
+		isoExtractionDuration.Observe(time.Since(start).Seconds())
+	}()
 	sourceISO := esxiFilePath
 	bootFileDir := s.FileRootDirInfo.BootFileDirPath
 	isoWriteRoot := filepath.Join(bootFileDir, filename)
@@ -216,8 +220,8 @@ func copyBootFiles(config *config.Config, bootFileDir, src, filename string, nee
 			}
 			defer dstFile.Close()
 
-			prefixPath := `prefix=http://{{.KSServerAddr}}:{{.KSServerPort}}/installer/{{.Filename}}/esxi`
-			kerneloptPath := `kernelopt=runweasel ks=http://{{.KSServerAddr}}:{{.KSServerPort}}/ks`
+			prefixPath := `prefix={{.KSServerScheme}}://{{.KSServerAddr}}:{{.KSServerPort}}/installer/{{.Filename}}/esxi`
+			kerneloptPath := `kernelopt=runweasel ks={{.KSServerScheme}}://{{.KSServerAddr}}:{{.KSServerPort}}/ks{{.KSPath}}`
 			content, err := io.ReadAll(srcFile)
 			if err != nil {
 				return err
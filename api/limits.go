@@ -0,0 +1,145 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limitBody rejects request bodies larger than limit bytes with 413 Request Entity Too Large.
+// A body announcing its size is rejected upfront, others fail once limit bytes have been read.
+func (s *Server) limitBody(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limit <= 0 {
+			next(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			s.logger.Warn(fmt.Sprintf("rejected %s request to %s from %s with a body of %d bytes", r.Method, r.URL.Path, r.RemoteAddr, r.ContentLength))
+			writeBodyTooLarge(w, r, limit)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r)
+	}
+}
+
+// isBodyTooLarge tells whether err comes from reading past the limit set by limitBody.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", limit))
+}
+
+// writeTooManyRequests answers r with 429 Too Many Requests, telling the client when to try again.
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, message)
+}
+
+// tokenBucket holds the requests a client can still send at once.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter lets each client send rate requests per second on average, and up to burst requests at once.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	clients   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of client, or returns how long the client has to wait for one.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+	bucket, found := l.clients[client]
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune forgets the clients whose bucket has filled up again, at most once a minute.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for client, bucket := range l.clients {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// rateLimit is a middleware answering 429 Too Many Requests to clients sending more requests than RATE_LIMIT allows.
+// Clients are told apart by IP address.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if ok, retryAfter := s.limiter.allow(client, time.Now()); !ok {
+			s.logger.Warn(fmt.Sprintf("rate limited %s request to %s from %s", r.Method, r.URL.Path, client))
+			writeTooManyRequests(w, r, retryAfter, "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquireUploadSlot reserves one of the MAX_CONCURRENT_UPLOADS slots, returning false if they are all taken.
+func (s *Server) acquireUploadSlot() bool {
+	if s.uploadSlots == nil {
+		return true
+	}
+	select {
+	case s.uploadSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseUploadSlot() {
+	if s.uploadSlots != nil {
+		<-s.uploadSlots
+	}
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Now()
+	type request struct {
+		client         string
+		after          time.Duration
+		wantAllowed    bool
+		wantRetryAfter time.Duration
+	}
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		requests []request
+	}{
+		{
+			name: "burst then wait for a token",
+			rate: 1, burst: 2,
+			requests: []request{
+				{"a", 0, true, 0},
+				{"a", 0, true, 0},
+				{"a", 0, false, time.Second},
+				{"a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+				{"a", time.Second, true, 0},
+			},
+		},
+		{
+			name: "clients have their own bucket",
+			rate: 1, burst: 1,
+			requests: []request{
+				{"a", 0, true, 0},
+				{"b", 0, true, 0},
+				{"a", 0, false, time.Second},
+			},
+		},
+		{
+			name: "bucket does not fill up past the burst",
+			rate: 10, burst: 2,
+			requests: []request{
+				{"a", 0, true, 0},
+				{"a", time.Hour, true, 0},
+				{"a", time.Hour, true, 0},
+				{"a", time.Hour, false, 100 * time.Millisecond},
+			},
+		},
+		{
+			name: "burst is at least one",
+			rate: 1, burst: 0,
+			requests: []request{
+				{"a", 0, true, 0},
+				{"a", 0, false, time.Second},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.rate, tt.burst)
+			for i, req := range tt.requests {
+				allowed, retryAfter := l.allow(req.client, start.Add(req.after))
+				if allowed != req.wantAllowed || retryAfter != req.wantRetryAfter {
+					t.Errorf("request %d: allow() = %v, %s, want %v, %s", i+1, allowed, retryAfter, req.wantAllowed, req.wantRetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	start := time.Now()
+	l := newRateLimiter(1, 2)
+	l.allow("a", start)
+	l.allow("b", start)
+	l.allow("b", start)
+	// After a minute, both buckets are full again and forgotten.
+	l.allow("c", start.Add(time.Minute))
+	if _, found := l.clients["a"]; found {
+		t.Errorf("full bucket of a is kept")
+	}
+	if _, found := l.clients["b"]; found {
+		t.Errorf("full bucket of b is kept")
+	}
+	if _, found := l.clients["c"]; !found {
+		t.Errorf("bucket of c is forgotten")
+	}
+}
+
+func TestManagementRouterLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		setup          func(s *Server)
+		method         string
+		path           string
+		body           string
+		chunked        bool
+		requests       int
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{
+			name:       "body announced larger than the limit",
+			method:     http.MethodPost,
+			path:       "/api/v1/ks",
+			body:       `{"hostname":"` + strings.Repeat("a", 2048) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "chunked body larger than the limit",
+			method:     http.MethodPost,
+			path:       "/api/v1/ks",
+			body:       `{"hostname":"` + strings.Repeat("a", 2048) + `"}`,
+			chunked:    true,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "chunked bulk body larger than the bulk limit",
+			method:     http.MethodPost,
+			path:       "/api/v1/ks/bulk",
+			body:       `[{"hostname":"` + strings.Repeat("a", 8192) + `"}]`,
+			chunked:    true,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "bulk body within the bulk limit",
+			method:     http.MethodPost,
+			path:       "/api/v1/ks/bulk",
+			body:       `[{"hostname":"` + strings.Repeat("a", 2048) + `"}]`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "too many requests",
+			setup:          func(s *Server) { s.limiter = newRateLimiter(1, 2) },
+			method:         http.MethodGet,
+			path:           "/api/v1/esxi-versions",
+			requests:       3,
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: "1",
+		},
+		{
+			name:       "requests within the rate limit",
+			setup:      func(s *Server) { s.limiter = newRateLimiter(1, 2) },
+			method:     http.MethodGet,
+			path:       "/api/v1/esxi-versions",
+			requests:   2,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "every upload slot is taken",
+			setup: func(s *Server) {
+				s.uploadSlots = make(chan struct{}, 1)
+				s.uploadSlots <- struct{}{}
+			},
+			method:         http.MethodPost,
+			path:           "/api/v1/upload",
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: "60",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.cfg.MaxRequestBodySize = 1024
+			s.cfg.MaxBulkBodySize = 4096
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			router := s.managementRouter()
+			requests := tt.requests
+			if requests == 0 {
+				requests = 1
+			}
+			var w *httptest.ResponseRecorder
+			for i := 0; i < requests; i++ {
+				req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+				req.Header.Set("Content-Type", "application/json")
+				if tt.chunked {
+					req.ContentLength = -1
+				}
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"io"
+	"kickstart/common"
+	"kickstart/config"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	installerBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ks_installer_bytes_total",
+		Help: "Bytes of installer files served over HTTP by file.",
+	}, []string{"file"})
+	isoExtractionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ks_iso_extraction_duration_seconds",
+		Help:    "Time taken to extract an uploaded ISO.",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600},
+	})
+)
+
+// registerStoreMetrics exposes the number of registrations and the free IPs left in the DHCP range.
+func registerStoreMetrics(store *common.Store, dhcpCfg *config.DHCPLeaseConfig) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ks_active_registrations",
+		Help: "Hosts currently registered.",
+	}, func() float64 {
+		return float64(len(store.List()))
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ks_dhcp_free_ips",
+		Help: "IPs in the DHCP range not assigned to any registration.",
+	}, func() float64 {
+		start := common.IPToInt(dhcpCfg.DHCPStartIP)
+		end := common.IPToInt(dhcpCfg.DHCPEndIP)
+		if end < start {
+			return 0
+		}
+		free := float64(end-start) + 1
+		for _, ip := range store.UsedIPs() {
+			if n := common.IPToInt(ip); n >= start && n <= end {
+				free--
+			}
+		}
+		return free
+	})
+}
+
+// countingResponseWriter counts the bytes of the response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom lets io.Copy hand the body to the ReadFrom of the wrapped writer, so that files are still sent with sendfile.
+func (w *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.written += n
+	return n, err
+}
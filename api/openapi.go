@@ -0,0 +1,62 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+// toJSONValue converts a value decoded by yaml.v2 into one that encoding/json can encode.
+func toJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			m[fmt.Sprint(key)] = toJSONValue(child)
+		}
+		return m
+	case []interface{}:
+		for i, child := range v {
+			v[i] = toJSONValue(child)
+		}
+	}
+	return value
+}
+
+// getOpenAPI serves the OpenAPI document of the versioned API, as JSON if the client accepts it.
+func (s *Server) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPIDocument)
+		return
+	}
+
+	var document interface{}
+	if err := yaml.Unmarshal(openAPIDocument, &document); err != nil {
+		s.logger.Error("failed to decode OpenAPI document", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(toJSONValue(document)); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+	}
+}
+
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.getOpenAPI(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"kickstart/common"
+	"kickstart/config"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// previewKSPath and previewCompletionToken stand for the tokens in previewed files, since tokens are only issued at registration.
+const (
+	previewKSPath          = "/<token>"
+	previewCompletionToken = "<token>"
+)
+
+// previewFirmwares are the firmware types whose DHCP boot filename is previewed, with the DHCP request they send.
+var previewFirmwares = []struct {
+	name string
+	arch uint16
+	iPXE bool
+}{
+	{"bios", common.ArchBIOS, false},
+	{"bios_ipxe", common.ArchBIOS, true},
+	{"uefi", common.ArchUEFIX64, false},
+	{"uefi_ipxe", common.ArchUEFIX64, true},
+	{"uefi_http", common.ArchUEFIHTTP, false},
+}
+
+// PreviewResponse holds what a host would be served if the previewed registration were made.
+type PreviewResponse struct {
+	KS         KS     `json:"ks"`
+	KSConfig   string `json:"kscfg"`
+	BootConfig string `json:"bootcfg"`
+	// BootFilenames is the boot filename handed out by DHCP for each firmware type.
+	BootFilenames map[string]string `json:"boot_filenames"`
+}
+
+// previewKsConfig validates a registration request like createKsConfig does,
+// and answers with the ks.cfg, boot.cfg and DHCP boot filenames the host would get, without registering anything.
+func (s *Server) previewKsConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		s.logger.Error("invalid Content-Type received")
+		writeError(w, r, http.StatusUnsupportedMediaType, "invalid Content-Type")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Error("could not read request body", zap.Error(err))
+		if isBodyTooLarge(err) {
+			writeBodyTooLarge(w, r, s.cfg.MaxRequestBodySize)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+
+	var ks KS
+	if !s.decodeKS(w, r, body, &ks) {
+		return
+	}
+	ks.Macaddress = strings.ToLower(ks.Macaddress)
+
+	err = ks.Validate()
+	if err != nil {
+		s.logger.Error("validate request error", zap.Error(err))
+		writeValidationError(w, r, err)
+		return
+	}
+
+	err = s.validateISO(ks)
+	if err != nil {
+		s.logger.Error("validate iso error", zap.Error(err))
+		writeValidationError(w, r, err)
+		return
+	}
+
+	conflicts := s.registrationConflicts(ks, registeredHosts(s.store.List()))
+	if conflict := s.reregistrationConflict(ks); conflict != "" && !forced(r) {
+		conflicts = append(conflicts, conflict)
+	}
+	if len(conflicts) > 0 {
+		s.logger.Error(fmt.Sprintf("preview of MAC %s conflicts with existing registrations: %s", ks.Macaddress, strings.Join(conflicts, "; ")))
+		writeConflicts(w, r, conflicts)
+		return
+	}
+
+	err = ks.hashPassword()
+	if err != nil {
+		s.logger.Error("failed to hash password", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+
+	var kscfg bytes.Buffer
+	err = s.renderKsConfig(&kscfg, ks, previewCompletionToken)
+	if err != nil {
+		s.logger.Error("failed to render ks config", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+
+	tmpl, err := common.ParseBootCfgTemplate(filepath.Join(s.FileRootDirInfo.BootFileDirPath, ks.ISOFilename, "boot.cfg"))
+	if err != nil {
+		s.logger.Error("failed to open boot.cfg", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+	var bootcfg bytes.Buffer
+	data := common.LoadBootCfgTemplateData(config.InstallerScheme(s.cfg), s.cfg.ServicePortAddr.String(), strconv.Itoa(s.cfg.BootServerPort), ks.ISOFilename, previewKSPath)
+	err = tmpl.Execute(&bootcfg, data)
+	if err != nil {
+		s.logger.Error("failed to render boot.cfg", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+
+	response := PreviewResponse{
+		KS:            ks.redacted(),
+		KSConfig:      ks.redactKsConfig(kscfg.String()),
+		BootConfig:    bootcfg.String(),
+		BootFilenames: make(map[string]string, len(previewFirmwares)),
+	}
+	for _, firmware := range previewFirmwares {
+		if filename, ok := common.BootFilename(s.cfg, ks.ISOFilename, firmware.arch, firmware.iPXE); ok {
+			response.BootFilenames[firmware.name] = filename
+		}
+	}
+	if err := writeJSON(w, http.StatusOK, response); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+	}
+}
+
+func (s *Server) ksPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		s.previewKsConfig(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
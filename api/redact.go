@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"kickstart/common"
+	"regexp"
+	"strings"
+)
+
+// completionToken matches the completion token in the completion URL of a ks.cfg.
+var completionToken = regexp.MustCompile(`(/complete/)[0-9a-f]+`)
+
+// secretCLIKey is the KS key listing the indexes of the CLI commands to keep secret.
+const secretCLIKey = "secretcli"
+
+func (k KS) validateSecretCLI(value interface{}) error {
+	seen := make(map[int]bool)
+	for _, i := range k.SecretCLI {
+		if i < 0 || i >= len(k.CLI) {
+			return fmt.Errorf("index %d is out of the range of cli", i)
+		}
+		if seen[i] {
+			return fmt.Errorf("index %d is given more than once", i)
+		}
+		seen[i] = true
+	}
+	return nil
+}
+
+// replacesCLIOnly tells whether a PATCH body replaces the cli commands without secretcli,
+// in which case the stored indexes no longer point at the right commands and are dropped.
+func replacesCLIOnly(body []byte) bool {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return false
+	}
+	_, cli := keys["cli"]
+	_, secretCLI := keys[secretCLIKey]
+	return cli && !secretCLI
+}
+
+// isSecretCLI tells whether the i-th CLI command is marked as secret.
+func (k KS) isSecretCLI(i int) bool {
+	for _, secret := range k.SecretCLI {
+		if secret == i {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns k as shown to API clients, with its password and secret CLI commands masked.
+// Unmarked CLI commands only have the values of password-like options masked.
+func (k KS) redacted() KS {
+	k.Password = common.RedactedValue
+	if k.CLI != nil {
+		cli := make([]string, len(k.CLI))
+		for i, command := range k.CLI {
+			if k.isSecretCLI(i) {
+				cli[i] = common.RedactedValue
+			} else {
+				cli[i] = common.RedactString(command)
+			}
+		}
+		k.CLI = cli
+	}
+	return k
+}
+
+// restoreRedacted puts back the values of stored that k holds in their redacted form,
+// so that a registration read from the API can be sent back without losing its secrets.
+func (k *KS) restoreRedacted(stored KS) {
+	if k.Password == common.RedactedValue {
+		k.Password = stored.Password
+	}
+	shown := stored.redacted()
+	for i := range k.CLI {
+		if i < len(stored.CLI) && k.CLI[i] == shown.CLI[i] {
+			k.CLI[i] = stored.CLI[i]
+			// A secret command sent back masked stays secret.
+			if stored.isSecretCLI(i) && !k.isSecretCLI(i) {
+				k.SecretCLI = append(k.SecretCLI, i)
+			}
+		}
+	}
+}
+
+// redactKsConfig masks the secrets of k in its rendered ks.cfg, and the completion token.
+func (k KS) redactKsConfig(kscfg string) string {
+	if k.Password != "" {
+		kscfg = strings.Replace(kscfg, k.Password, common.RedactedValue, -1)
+	}
+	for i, command := range k.CLI {
+		if k.isSecretCLI(i) && command != "" {
+			kscfg = strings.Replace(kscfg, command, common.RedactedValue, -1)
+		}
+	}
+	kscfg = completionToken.ReplaceAllString(kscfg, "${1}"+common.RedactedValue)
+	return common.RedactString(kscfg)
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/json"
+	"kickstart/common"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+var secretKS = KS{
+	Macaddress: "00:50:56:aa:bb:01",
+	Password:   "VMware1!",
+	CLI: []string{
+		"vim-cmd hostsvc/enable_ssh",
+		"esxcli network firewall set --enabled false --token=abc123",
+		"/opt/join.sh administrator@vsphere.local Secr3t",
+	},
+	SecretCLI: []int{2},
+}
+
+func TestRedacted(t *testing.T) {
+	got := secretKS.redacted()
+	want := []string{
+		"vim-cmd hostsvc/enable_ssh",
+		"esxcli network firewall set --enabled false --token=********",
+		"********",
+	}
+	if got.Password != "********" {
+		t.Errorf("password = %q, want it masked", got.Password)
+	}
+	if !reflect.DeepEqual(got.CLI, want) {
+		t.Errorf("cli = %q, want %q", got.CLI, want)
+	}
+	// The registration itself keeps its secrets.
+	if secretKS.Password != "VMware1!" || secretKS.CLI[2] != "/opt/join.sh administrator@vsphere.local Secr3t" {
+		t.Errorf("redacted() changed the registration it was called on")
+	}
+}
+
+func TestRestoreRedacted(t *testing.T) {
+	tests := []struct {
+		name         string
+		change       func(ks *KS)
+		wantPassword string
+		wantCLI      []string
+	}{
+		{
+			name:         "sent back as read",
+			change:       func(ks *KS) {},
+			wantPassword: secretKS.Password,
+			wantCLI:      secretKS.CLI,
+		},
+		{
+			name:         "new password",
+			change:       func(ks *KS) { ks.Password = "VMware2!" },
+			wantPassword: "VMware2!",
+			wantCLI:      secretKS.CLI,
+		},
+		{
+			name: "edited and added commands",
+			change: func(ks *KS) {
+				ks.CLI[1] = "esxcli network firewall set --enabled true"
+				ks.CLI = append(ks.CLI, "vim-cmd hostsvc/start_ssh")
+			},
+			wantPassword: secretKS.Password,
+			wantCLI: []string{
+				"vim-cmd hostsvc/enable_ssh",
+				"esxcli network firewall set --enabled true",
+				"/opt/join.sh administrator@vsphere.local Secr3t",
+				"vim-cmd hostsvc/start_ssh",
+			},
+		},
+		{
+			name:         "removed commands",
+			change:       func(ks *KS) { ks.CLI = ks.CLI[:1] },
+			wantPassword: secretKS.Password,
+			wantCLI:      secretKS.CLI[:1],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks := secretKS.redacted()
+			tt.change(&ks)
+			ks.restoreRedacted(secretKS)
+			if ks.Password != tt.wantPassword {
+				t.Errorf("password = %q, want %q", ks.Password, tt.wantPassword)
+			}
+			if !reflect.DeepEqual(ks.CLI, tt.wantCLI) {
+				t.Errorf("cli = %q, want %q", ks.CLI, tt.wantCLI)
+			}
+		})
+	}
+}
+
+func TestRedactKsConfig(t *testing.T) {
+	kscfg := strings.Join([]string{
+		"rootpw --iscrypted VMware1!",
+		"%firstboot --interpreter=busybox",
+		"vim-cmd hostsvc/enable_ssh",
+		"esxcli network firewall set --enabled false --token=abc123",
+		"/opt/join.sh administrator@vsphere.local Secr3t",
+		"wget -q -O - https://172.16.0.1/api/v1/ks/00-50-56-aa-bb-01/complete/0123456789abcdef",
+	}, "\n")
+	got := secretKS.redactKsConfig(kscfg)
+	for _, secret := range []string{"VMware1!", "abc123", "Secr3t", "0123456789abcdef"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redactKsConfig() leaves %q in %s", secret, got)
+		}
+	}
+	for _, kept := range []string{"vim-cmd hostsvc/enable_ssh", "/complete/********"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("redactKsConfig() = %s, want it to hold %q", got, kept)
+		}
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	body, err := json.Marshal([]KS{secretKS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(redactJSON(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"VMware1!", "abc123", "Secr3t"} {
+		if strings.Contains(string(got), secret) {
+			t.Errorf("redactJSON() leaves %q in %s", secret, got)
+		}
+	}
+	if !strings.Contains(string(got), `"secretcli":[2]`) {
+		t.Errorf("redactJSON() = %s, want the secretcli indexes kept", got)
+	}
+	if redactJSON([]byte("not json")) != nil {
+		t.Errorf("redactJSON() of a body that is not JSON is not nil")
+	}
+}
+
+func TestPatchCLIWithoutSecretCLI(t *testing.T) {
+	stored := KS{
+		Macaddress:  "00:50:56:aa:bb:01",
+		Password:    "VMware1!",
+		IP:          "172.16.0.11",
+		Netmask:     "255.255.255.0",
+		Gateway:     "172.16.0.254",
+		Nameserver:  "172.16.0.254",
+		Hostname:    "esxi01",
+		ISOFilename: testISO,
+		CLI:         secretKS.CLI,
+		SecretCLI:   secretKS.SecretCLI,
+	}
+	tests := []struct {
+		name          string
+		body          string
+		wantCLI       []string
+		wantSecretCLI []int
+	}{
+		{
+			name:          "cli not patched",
+			body:          `{"hostname":"esxi02"}`,
+			wantCLI:       secretKS.CLI,
+			wantSecretCLI: []int{2},
+		},
+		{
+			name:    "shorter cli",
+			body:    `{"cli":["vim-cmd hostsvc/start_ssh"]}`,
+			wantCLI: []string{"vim-cmd hostsvc/start_ssh"},
+		},
+		{
+			name:    "other cli of the same length",
+			body:    `{"cli":["a","b","c"]}`,
+			wantCLI: []string{"a", "b", "c"},
+		},
+		{
+			name:          "cli with secretcli",
+			body:          `{"cli":["a","b"],"secretcli":[0]}`,
+			wantCLI:       []string{"a", "b"},
+			wantSecretCLI: []int{0},
+		},
+		{
+			name:          "secret command sent back masked",
+			body:          `{"cli":["a","b","********"]}`,
+			wantCLI:       []string{"a", "b", secretKS.CLI[2]},
+			wantSecretCLI: []int{2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			registered := stored
+			if err := registered.hashPassword(); err != nil {
+				t.Fatal(err)
+			}
+			payload, err := json.Marshal(registered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.store.Upsert(stored.Macaddress, func(reg *common.Registration) error {
+				reg.KS = payload
+				reg.Hostname = stored.Hostname
+				// The DHCP range of the test server holds no IP to assign.
+				reg.IP = net.ParseIP("172.16.0.50")
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPatch, "/api/v1/ks/00-50-56-aa-bb-01", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req = mux.SetURLVars(req, map[string]string{"id": "00-50-56-aa-bb-01"})
+			w := httptest.NewRecorder()
+			s.updateKsConfig(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			reg, _ := s.store.Get(stored.Macaddress)
+			got, err := registrationKS(reg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.CLI, tt.wantCLI) {
+				t.Errorf("cli = %q, want %q", got.CLI, tt.wantCLI)
+			}
+			if !reflect.DeepEqual(got.SecretCLI, tt.wantSecretCLI) {
+				t.Errorf("secretcli = %v, want %v", got.SecretCLI, tt.wantSecretCLI)
+			}
+		})
+	}
+}
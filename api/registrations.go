@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"kickstart/common"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type RegistrationSummary struct {
+	Macaddress  string       `json:"macaddress"`
+	IP          string       `json:"ip,omitempty"`
+	ISOFilename string       `json:"isofilename"`
+	Hostname    string       `json:"hostname,omitempty"`
+	VMKIP       string       `json:"vmk0_ip,omitempty"`
+	Phase       common.Phase `json:"phase"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+type RegistrationListResponse struct {
+	Registrations []RegistrationSummary `json:"registrations"`
+	Total         int                   `json:"total"`
+	Offset        int                   `json:"offset"`
+	Limit         int                   `json:"limit"`
+}
+
+type RegistrationResponse struct {
+	RegistrationSummary
+	KS       *KS    `json:"ks,omitempty"`
+	KSConfig string `json:"kscfg"`
+}
+
+// registrationKS decodes the registration request stored with reg.
+// Registrations made before requests were stored have none.
+func registrationKS(reg common.Registration) (*KS, error) {
+	if len(reg.KS) == 0 {
+		return nil, nil
+	}
+	var ks KS
+	if err := json.Unmarshal(reg.KS, &ks); err != nil {
+		return nil, fmt.Errorf("failed to decode registration of MAC %s: %w", reg.Macaddress, err)
+	}
+	return &ks, nil
+}
+
+func summarizeRegistration(reg common.Registration, ks *KS) RegistrationSummary {
+	summary := RegistrationSummary{
+		Macaddress:  reg.Macaddress,
+		ISOFilename: reg.ISOFilename,
+		Hostname:    reg.Hostname,
+		Phase:       reg.Lifecycle.Phase,
+		CreatedAt:   reg.CreatedAt,
+	}
+	if reg.IP != nil {
+		summary.IP = reg.IP.String()
+	}
+	if ks != nil {
+		summary.VMKIP = ks.IP
+	}
+	return summary
+}
+
+// queryInt returns the integer query parameter name of r, or fallback if it is not set.
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+// listRegistrations returns the registrations, oldest first, narrowed down by the mac, hostname, ip, isofilename and phase query parameters.
+// The ip parameter matches both the PXE IP and the vmk0 IP. The offset and limit parameters page through the result.
+func (s *Server) listRegistrations(w http.ResponseWriter, r *http.Request) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if limit == 0 || limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	query := r.URL.Query()
+	mac := macFromID(query.Get("mac"))
+	hostname := query.Get("hostname")
+	ip := query.Get("ip")
+	isoFilename := query.Get("isofilename")
+	phase := query.Get("phase")
+
+	summaries := []RegistrationSummary{}
+	for _, reg := range s.store.List() {
+		ks, err := registrationKS(reg)
+		if err != nil {
+			s.logger.Warn(err.Error())
+		}
+		summary := summarizeRegistration(reg, ks)
+		if mac != "" && !strings.EqualFold(summary.Macaddress, mac) {
+			continue
+		}
+		if hostname != "" && !strings.EqualFold(summary.Hostname, hostname) {
+			continue
+		}
+		if ip != "" && summary.IP != ip && summary.VMKIP != ip {
+			continue
+		}
+		if isoFilename != "" && summary.ISOFilename != isoFilename {
+			continue
+		}
+		if phase != "" && string(summary.Phase) != phase {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+
+	response := RegistrationListResponse{
+		Registrations: []RegistrationSummary{},
+		Total:         len(summaries),
+		Offset:        offset,
+		Limit:         limit,
+	}
+	if offset < len(summaries) {
+		end := offset + limit
+		if end > len(summaries) {
+			end = len(summaries)
+		}
+		response.Registrations = summaries[offset:end]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// getRegistration returns one registration together with its rendered ks.cfg.
+func (s *Server) getRegistration(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	mac := macFromID(id)
+
+	reg, found := s.store.Get(mac)
+	if !found {
+		s.logger.Error(fmt.Sprintf("no registration found for MAC %s", mac))
+		writeError(w, r, http.StatusNotFound, "registration not found")
+		return
+	}
+	ks, err := registrationKS(reg)
+	if err != nil {
+		s.logger.Error("failed to read registration", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+	kscfg, err := os.ReadFile(s.ksFilePath(reg.Macaddress))
+	if err != nil {
+		s.logger.Error("failed to read ks config file", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, "encountered unexpected problem")
+		return
+	}
+
+	response := RegistrationResponse{
+		RegistrationSummary: summarizeRegistration(reg, ks),
+		KSConfig:            common.RedactString(string(kscfg)),
+	}
+	if ks != nil {
+		shown := ks.redacted()
+		response.KS = &shown
+		response.KSConfig = ks.redactKsConfig(string(kscfg))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger.Error("failed to generate response", zap.Error(err))
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"kickstart/config"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+)
+
+// tlsDirPath returns where the self-signed CA and the certificate it signs are kept.
+func tlsDirPath(cfg *config.Config) string {
+	return filepath.Join(cfg.FileDirPath, "tls")
+}
+
+func caCertPath(cfg *config.Config) string {
+	return filepath.Join(tlsDirPath(cfg), "ca.crt")
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+// loadOrCreateCA returns the self-signed CA of the server, creating it on first use.
+// The CA is kept across restarts so that clients trusting it keep doing so.
+func loadOrCreateCA(cfg *config.Config) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := caCertPath(cfg)
+	keyPath := filepath.Join(tlsDirPath(cfg), "ca.key")
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return nil, nil, errors.New("failed to decode self-signed CA")
+		}
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	}
+
+	err := os.MkdirAll(tlsDirPath(cfg), 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Kickstart Server CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// selfSignedCertificate returns a server certificate signed by the self-signed CA, valid for the addresses of the server.
+// It is issued again on every start, so it always names the current addresses.
+func selfSignedCertificate(cfg *config.Config) (tls.Certificate, error) {
+	ca, caKey, err := loadOrCreateCA(cfg)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load self-signed CA: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Kickstart Server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serverValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	for _, ip := range []net.IP{cfg.APIPortAddr, cfg.ServicePortAddr} {
+		if ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+	if cfg.CallbackServerAddr != "" {
+		if ip := net.ParseIP(cfg.CallbackServerAddr); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, cfg.CallbackServerAddr)
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.Raw}, PrivateKey: key}, nil
+}
+
+// loadTLSConfig returns the TLS config of the API server, using TLS_CERT_PATH and TLS_KEY_PATH if they are set,
+// and a certificate signed by a self-signed CA otherwise.
+func loadTLSConfig(cfg *config.Config, logger *zap.Logger) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if cfg.TLSCertPath != "" || cfg.TLSKeyPath != "" {
+		cert, err = tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+	} else {
+		cert, err = selfSignedCertificate(cfg)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("serving with a certificate signed by the self-signed CA %s", caCertPath(cfg)))
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// getCACert serves the self-signed CA so that clients can trust it.
+func (s *Server) getCACert(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.TLSEnabled || s.cfg.TLSCertPath != "" {
+		writeError(w, r, http.StatusNotFound, "no self-signed CA in use")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	http.ServeFile(w, r, caCertPath(s.cfg))
+}
+
+func (s *Server) caCertHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.getCACert(w, r)
+	default:
+		s.logger.Warn(fmt.Sprintf("method %s not allowed", r.Method))
+		writeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
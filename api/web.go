@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"text/template"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -20,7 +21,20 @@ type ErrorTemplateData struct {
 	Error       string
 }
 
-func errorResponseHandler(w http.ResponseWriter, form ErrorTemplateData, errcode int) error {
+type UploadResponse struct {
+	Filename string `json:"filename"`
+}
+
+// errorResponseHandler answers r with an error page, or with an ErrorResponse for JSON clients.
+func errorResponseHandler(w http.ResponseWriter, r *http.Request, form ErrorTemplateData, errcode int) error {
+	if wantsJSON(r) {
+		response := ErrorResponse{Message: form.Description}
+		if form.Error != "" {
+			response.Details = []string{form.Error}
+		}
+		writeErrorResponse(w, r, errcode, response)
+		return nil
+	}
 	errorform := `
 	<!DOCTYPE html>
 	<html lang="en">
@@ -66,23 +80,34 @@ func (s *Server) getUploadFileHandler(config *config.Config) http.HandlerFunc {
 				Description: fmt.Sprintf("%s method is not allowed. POST request is supported.", r.Method),
 				Error:       "",
 			}
-			err := errorResponseHandler(w, form, http.StatusMethodNotAllowed)
+			err := errorResponseHandler(w, r, form, http.StatusMethodNotAllowed)
 			if err != nil {
 				s.logger.Error("error raised response handler", zap.Error(err))
 			}
 			return
 		}
 
+		if !s.acquireUploadSlot() {
+			s.logger.Warn(fmt.Sprintf("rejected upload from %s, %d uploads are already in progress", r.RemoteAddr, cap(s.uploadSlots)))
+			writeTooManyRequests(w, r, time.Minute, fmt.Sprintf("%d uploads are already in progress, try again later", cap(s.uploadSlots)))
+			return
+		}
+		defer s.releaseUploadSlot()
+
 		file, header, err := r.FormFile("file")
 		if err != nil {
 			s.logger.Error("error retrieving the file", zap.Error(err))
+			if isBodyTooLarge(err) {
+				writeBodyTooLarge(w, r, s.cfg.MaxUploadSize)
+				return
+			}
 			form := ErrorTemplateData{
 				Title:       "Error retrieving the file",
 				Message:     "Error retrieving the file",
 				Description: "Failed retrieving the file. Please confirm the following error message.",
 				Error:       err.Error(),
 			}
-			err := errorResponseHandler(w, form, http.StatusBadRequest)
+			err := errorResponseHandler(w, r, form, http.StatusBadRequest)
 			if err != nil {
 				s.logger.Error("error raised response handler", zap.Error(err))
 			}
@@ -97,7 +122,7 @@ func (s *Server) getUploadFileHandler(config *config.Config) http.HandlerFunc {
 				Description: "This file is not an `.iso` file. Only `.iso` files are supported.",
 				Error:       "",
 			}
-			err := errorResponseHandler(w, form, http.StatusBadRequest)
+			err := errorResponseHandler(w, r, form, http.StatusBadRequest)
 			if err != nil {
 				s.logger.Error("error raised response handler", zap.Error(err))
 			}
@@ -113,7 +138,7 @@ func (s *Server) getUploadFileHandler(config *config.Config) http.HandlerFunc {
 				Description: "Failed creating the file. Please confirm the following error message.",
 				Error:       err.Error(),
 			}
-			err := errorResponseHandler(w, form, http.StatusInternalServerError)
+			err := errorResponseHandler(w, r, form, http.StatusInternalServerError)
 			if err != nil {
 				s.logger.Error("error raised response handler", zap.Error(err))
 			}
@@ -130,7 +155,7 @@ func (s *Server) getUploadFileHandler(config *config.Config) http.HandlerFunc {
 				Description: "Failed saving the file. Please confirm the following error message.",
 				Error:       err.Error(),
 			}
-			err := errorResponseHandler(w, form, http.StatusInternalServerError)
+			err := errorResponseHandler(w, r, form, http.StatusInternalServerError)
 			if err != nil {
 				s.logger.Error("error raised response handler", zap.Error(err))
 			}
@@ -153,7 +178,7 @@ func (s *Server) getUploadFileHandler(config *config.Config) http.HandlerFunc {
 				Description: "Failed extracting ISO. Please confirm that the ISO file is a correct ESXi ISO.",
 				Error:       err.Error(),
 			}
-			err := errorResponseHandler(w, form, http.StatusBadRequest)
+			err := errorResponseHandler(w, r, form, http.StatusBadRequest)
 			if err != nil {
 				s.logger.Error("error raised response handler", zap.Error(err))
 			}
@@ -161,6 +186,12 @@ func (s *Server) getUploadFileHandler(config *config.Config) http.HandlerFunc {
 		}
 
 		s.logger.Info(fmt.Sprintf("file upload successfully %s", header.Filename))
+		if wantsJSON(r) {
+			if err := writeJSON(w, http.StatusOK, UploadResponse{Filename: header.Filename}); err != nil {
+				s.logger.Error("failed to generate response", zap.Error(err))
+			}
+			return
+		}
 
 		form := `
 		<!DOCTYPE html>
@@ -188,7 +219,7 @@ func (s *Server) uploadForm() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			s.logger.Error(fmt.Sprintf("method %s not allowed", r.Method))
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
 
@@ -0,0 +1,343 @@
+// Package client calls the kickstart management API from Go programs.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kickstart/api"
+	"kickstart/common"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is where the versioned API is served.
+const apiPrefix = "/api/v1"
+
+// defaultPollInterval is how often WaitForCompletion polls the status of a host unless PollInterval is set.
+const defaultPollInterval = 5 * time.Second
+
+// Client calls the management API of a kickstart server.
+type Client struct {
+	baseURL *url.URL
+	// HTTPClient sends the requests, http.DefaultClient if nil.
+	// Set its transport to trust the CA of a server using a self-signed certificate.
+	HTTPClient *http.Client
+	// Token is sent as a bearer token when set.
+	Token string
+	// Username and Password are sent with basic auth when set and Token is not.
+	Username string
+	Password string
+	// PollInterval is how often WaitForCompletion polls the status of a host.
+	PollInterval time.Duration
+}
+
+// New returns a client of the server whose management API is served at baseURL, such as https://192.168.0.10:8080.
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q: scheme must be http or https", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &Client{baseURL: u}, nil
+}
+
+// ListOptions narrows down the registrations returned by List. Zero values are ignored.
+type ListOptions struct {
+	Macaddress  string
+	Hostname    string
+	IP          string
+	ISOFilename string
+	Phase       common.Phase
+	Offset      int
+	Limit       int
+}
+
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	if o.Macaddress != "" {
+		query.Set("mac", o.Macaddress)
+	}
+	if o.Hostname != "" {
+		query.Set("hostname", o.Hostname)
+	}
+	if o.IP != "" {
+		query.Set("ip", o.IP)
+	}
+	if o.ISOFilename != "" {
+		query.Set("isofilename", o.ISOFilename)
+	}
+	if o.Phase != "" {
+		query.Set("phase", string(o.Phase))
+	}
+	if o.Offset > 0 {
+		query.Set("offset", strconv.Itoa(o.Offset))
+	}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return query
+}
+
+// ProgressFunc is called as an upload goes on with the bytes of the file sent so far and its size.
+type ProgressFunc func(sent, total int64)
+
+// Register registers a host and returns the registration as stored, with its secrets masked.
+// With force, an existing registration of the same MAC address is replaced.
+func (c *Client) Register(ctx context.Context, ks api.KS, force bool) (api.KS, error) {
+	var query url.Values
+	if force {
+		query = url.Values{"force": {"true"}}
+	}
+	var registered api.KS
+	err := c.doJSON(ctx, http.MethodPost, "/ks", query, ks, &registered)
+	return registered, err
+}
+
+// RegisterBulk registers hosts with a single request, so that they are either all registered or none of them is,
+// and returns the result of each host. With force, existing registrations of the same MAC addresses are replaced.
+// When the batch is rejected because of invalid rows, the returned Error holds the result of each row.
+func (c *Client) RegisterBulk(ctx context.Context, hosts []api.KS, force bool) (api.BulkResponse, error) {
+	var query url.Values
+	if force {
+		query = url.Values{"force": {"true"}}
+	}
+	var response api.BulkResponse
+	err := c.doJSON(ctx, http.MethodPost, "/ks/bulk", query, hosts, &response)
+	return response, err
+}
+
+// List returns the registrations matching opts, oldest first.
+func (c *Client) List(ctx context.Context, opts ListOptions) (api.RegistrationListResponse, error) {
+	var response api.RegistrationListResponse
+	err := c.doJSON(ctx, http.MethodGet, "/ks", opts.query(), nil, &response)
+	return response, err
+}
+
+// Get returns the registration of mac together with its rendered ks.cfg.
+func (c *Client) Get(ctx context.Context, mac string) (api.RegistrationResponse, error) {
+	var response api.RegistrationResponse
+	err := c.doJSON(ctx, http.MethodGet, "/ks/"+macID(mac), nil, nil, &response)
+	return response, err
+}
+
+// Delete deletes the registration of mac.
+func (c *Client) Delete(ctx context.Context, mac string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/ks/"+macID(mac), nil, nil, nil)
+}
+
+// Status returns the installation status of mac.
+func (c *Client) Status(ctx context.Context, mac string) (api.StatusResponse, error) {
+	var response api.StatusResponse
+	err := c.doJSON(ctx, http.MethodGet, "/ks/"+macID(mac)+"/status", nil, nil, &response)
+	return response, err
+}
+
+// ESXiVersions returns the ESXi version of each uploaded ISO.
+func (c *Client) ESXiVersions(ctx context.Context) (api.Response, error) {
+	var response api.Response
+	err := c.doJSON(ctx, http.MethodGet, "/esxi-versions", nil, nil, &response)
+	return response, err
+}
+
+// UploadISO uploads an ESXi ISO or offline depot zip of size bytes read from r, and waits for the server to extract it.
+// progress, if not nil, is called as the file is sent.
+func (c *Client) UploadISO(ctx context.Context, filename string, r io.Reader, size int64, progress ProgressFunc) (api.UploadResponse, error) {
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	if _, err := writer.CreateFormFile("file", filename); err != nil {
+		return api.UploadResponse{}, err
+	}
+	head := form.Len()
+	if err := writer.Close(); err != nil {
+		return api.UploadResponse{}, err
+	}
+	body := io.MultiReader(
+		bytes.NewReader(form.Bytes()[:head]),
+		&progressReader{reader: io.LimitReader(r, size), total: size, progress: progress},
+		bytes.NewReader(form.Bytes()[head:]),
+	)
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/upload", nil, body)
+	if err != nil {
+		return api.UploadResponse{}, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.ContentLength = int64(form.Len()) + size
+
+	var response api.UploadResponse
+	err = c.do(req, &response)
+	return response, err
+}
+
+// UploadISOFile uploads the ESXi ISO or offline depot zip at filePath, see UploadISO.
+func (c *Client) UploadISOFile(ctx context.Context, filePath string, progress ProgressFunc) (api.UploadResponse, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return api.UploadResponse{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return api.UploadResponse{}, err
+	}
+	return c.UploadISO(ctx, filepath.Base(filePath), file, info.Size(), progress)
+}
+
+// WaitForCompletion polls the status of mac until its installation completes, and returns the final status.
+// It returns an InstallFailedError if the installation fails, and stops when ctx is done.
+//
+// A server running with AUTO_CLEANUP_ON_COMPLETE deletes the registration as soon as the installation completes,
+// so the completed phase may never be seen. When the registration is gone after the host fetched its ks.cfg,
+// the installation is taken as completed: the last status seen is returned with its phase set to completed.
+func (c *Client) WaitForCompletion(ctx context.Context, mac string) (api.StatusResponse, error) {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	var last api.StatusResponse
+	for {
+		wait := interval
+		status, err := c.Status(ctx, mac)
+		var apiErr *Error
+		switch {
+		case errors.As(err, &apiErr) && errors.Is(err, ErrRateLimited):
+			if apiErr.RetryAfter > wait {
+				wait = apiErr.RetryAfter
+			}
+		case errors.Is(err, ErrNotFound) && last.Phase.Reached(common.PhaseKsFetched):
+			last.Phase = common.PhaseCompleted
+			return last, nil
+		case err != nil:
+			return status, err
+		case status.Phase == common.PhaseCompleted:
+			return status, nil
+		case status.Phase == common.PhaseFailed:
+			return status, &InstallFailedError{Status: status}
+		default:
+			last = status
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// macID turns a MAC address into the form used in API paths, such as 00-50-56-aa-bb-cc.
+func macID(mac string) string {
+	return url.PathEscape(strings.ToLower(strings.Replace(mac, ":", "-", -1)))
+}
+
+func (c *Client) newRequest(ctx context.Context, method, route string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *c.baseURL
+	u.Path = path.Join(u.Path, apiPrefix, route)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	return req, nil
+}
+
+// doJSON sends request encoded as JSON, unless it is nil, and decodes the answer into response, unless it is nil.
+func (c *Client) doJSON(ctx context.Context, method, route string, query url.Values, request, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := c.newRequest(ctx, method, route, query, body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(req, response)
+}
+
+// do sends req and decodes the answer into response, unless it is nil. Error statuses are returned as an Error.
+func (c *Client) do(req *http.Request, response interface{}) error {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return responseError(resp)
+	}
+	if response == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %w", req.Method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// responseError turns an error status into an Error, keeping the message of the API when it answered in JSON.
+func responseError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(data, &apiErr.ErrorResponse); err != nil {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	var bulk api.BulkResponse
+	if err := json.Unmarshal(data, &bulk); err == nil {
+		apiErr.Results = bulk.Results
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
+
+// progressReader reports the bytes read through it to progress.
+type progressReader struct {
+	reader   io.Reader
+	sent     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.sent += int64(n)
+	if r.progress != nil && n > 0 {
+		r.progress(r.sent, r.total)
+	}
+	return n, err
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kickstart/api"
+	"kickstart/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statusAnswer is a status answered with its phase, or an error answered with statusCode when phase is empty.
+type statusAnswer struct {
+	phase      common.Phase
+	statusCode int
+}
+
+// statusServer returns a client of a server answering the status requests with answers, one per request, repeating the last one.
+func statusServer(t *testing.T, answers []statusAnswer) *Client {
+	t.Helper()
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		answer := answers[len(answers)-1]
+		if polls < len(answers) {
+			answer = answers[polls]
+		}
+		polls++
+		w.Header().Set("Content-Type", "application/json")
+		if answer.phase == "" {
+			w.WriteHeader(answer.statusCode)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Message: http.StatusText(answer.statusCode)})
+			return
+		}
+		json.NewEncoder(w).Encode(api.StatusResponse{Macaddress: "00:50:56:aa:bb:01", ISOFilename: "a.iso", Phase: answer.phase})
+	}))
+	t.Cleanup(server.Close)
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PollInterval = time.Millisecond
+	return c
+}
+
+func TestWaitForCompletion(t *testing.T) {
+	notFound := statusAnswer{statusCode: http.StatusNotFound}
+	tests := []struct {
+		name      string
+		answers   []statusAnswer
+		wantPhase common.Phase
+		wantErr   error
+	}{
+		{
+			name:      "completed",
+			answers:   []statusAnswer{{phase: common.PhaseBootloader}, {phase: common.PhaseKsFetched}, {phase: common.PhaseCompleted}},
+			wantPhase: common.PhaseCompleted,
+		},
+		{
+			name:      "deleted on completion after fetching its ks.cfg",
+			answers:   []statusAnswer{{phase: common.PhaseBootCfg}, {phase: common.PhaseKsFetched}, notFound},
+			wantPhase: common.PhaseCompleted,
+		},
+		{
+			name:      "rate limited",
+			answers:   []statusAnswer{{statusCode: http.StatusTooManyRequests}, {phase: common.PhaseCompleted}},
+			wantPhase: common.PhaseCompleted,
+		},
+		{
+			name:    "not registered",
+			answers: []statusAnswer{notFound},
+			wantErr: ErrNotFound,
+		},
+		{
+			name:    "deleted before fetching its ks.cfg",
+			answers: []statusAnswer{{phase: common.PhaseBootloader}, notFound},
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := statusServer(t, tt.answers)
+			status, err := c.WaitForCompletion(context.Background(), "00:50:56:aa:bb:01")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("WaitForCompletion() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (status.Phase != tt.wantPhase || status.ISOFilename != "a.iso") {
+				t.Errorf("WaitForCompletion() = %+v, want phase %s", status, tt.wantPhase)
+			}
+		})
+	}
+}
+
+func TestWaitForCompletionFailed(t *testing.T) {
+	c := statusServer(t, []statusAnswer{{phase: common.PhaseKsFetched}, {phase: common.PhaseFailed}})
+	_, err := c.WaitForCompletion(context.Background(), "00:50:56:aa:bb:01")
+	var failed *InstallFailedError
+	if !errors.As(err, &failed) {
+		t.Errorf("WaitForCompletion() error = %v, want an InstallFailedError", err)
+	}
+}
+
+func TestRegisterBulk(t *testing.T) {
+	rejected := api.BulkResponse{Results: []api.BulkResult{
+		{Row: 1, Macaddress: "00:50:56:aa:bb:01", Status: "valid"},
+		{Row: 2, Macaddress: "00:50:56:aa:bb:02", Status: "error", Error: "ip: must be a valid IP address."},
+	}}
+	tests := []struct {
+		name       string
+		statusCode int
+		response   api.BulkResponse
+		wantErr    error
+		wantRows   int
+	}{
+		{
+			name:       "registered",
+			statusCode: http.StatusOK,
+			response: api.BulkResponse{Registered: 2, Results: []api.BulkResult{
+				{Row: 1, Macaddress: "00:50:56:aa:bb:01", IP: "172.16.0.2", Status: "registered"},
+				{Row: 2, Macaddress: "00:50:56:aa:bb:02", IP: "172.16.0.3", Status: "registered"},
+			}},
+		},
+		{name: "invalid row", statusCode: http.StatusBadRequest, response: rejected, wantErr: ErrBadRequest, wantRows: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []api.KS
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v1/ks/bulk" || r.URL.Query().Get("force") != "true" {
+					t.Errorf("request sent to %s", r.URL)
+				}
+				json.NewDecoder(r.Body).Decode(&got)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.statusCode)
+				json.NewEncoder(w).Encode(tt.response)
+			}))
+			defer server.Close()
+			c, err := New(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hosts := []api.KS{{Macaddress: "00:50:56:aa:bb:01"}, {Macaddress: "00:50:56:aa:bb:02"}}
+			response, err := c.RegisterBulk(context.Background(), hosts, true)
+			if len(got) != len(hosts) {
+				t.Errorf("sent %d hosts in the batch, want %d", len(got), len(hosts))
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RegisterBulk() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				if response.Registered != 2 {
+					t.Errorf("RegisterBulk() = %+v, want 2 hosts registered", response)
+				}
+				return
+			}
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || len(apiErr.Results) != tt.wantRows {
+				t.Fatalf("RegisterBulk() error = %#v, want the results of %d rows", err, tt.wantRows)
+			}
+			if want := "row 2 (00:50:56:aa:bb:02): ip: must be a valid IP address."; !strings.Contains(err.Error(), want) {
+				t.Errorf("RegisterBulk() error = %q, want it to report %q", err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"kickstart/api"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Errors matched by the Error returned for the status codes the API answers with, using errors.Is.
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrTooLarge     = errors.New("request body too large")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusConflict:              ErrConflict,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusTooManyRequests:       ErrRateLimited,
+}
+
+// Error is an error answered by the API.
+type Error struct {
+	StatusCode int
+	api.ErrorResponse
+	// RetryAfter is how long the server asked to wait before trying again, when rate limited.
+	RetryAfter time.Duration
+	// Results is the result of each row when a bulk registration is rejected.
+	Results []api.BulkResult
+}
+
+func (e *Error) Error() string {
+	message := e.Message
+	if message == "" {
+		message = http.StatusText(e.StatusCode)
+	}
+	if len(e.Fields) > 0 {
+		fields := make([]string, 0, len(e.Fields))
+		for field, fieldErr := range e.Fields {
+			fields = append(fields, fmt.Sprintf("%s: %s", field, fieldErr))
+		}
+		sort.Strings(fields)
+		message = strings.Join(fields, "; ")
+	}
+	if rows := rowErrors(e.Results); len(rows) > 0 {
+		message = strings.Join(rows, "; ")
+	}
+	return fmt.Sprintf("kickstart API answered %d: %s", e.StatusCode, message)
+}
+
+// Is tells whether target is the error matching the status code of e, such as ErrNotFound.
+func (e *Error) Is(target error) bool {
+	return statusErrors[e.StatusCode] == target
+}
+
+// rowErrors lists the errors of the rows of a rejected bulk registration.
+func rowErrors(results []api.BulkResult) []string {
+	var rows []string
+	for _, result := range results {
+		if result.Error != "" {
+			rows = append(rows, fmt.Sprintf("row %d (%s): %s", result.Row, result.Macaddress, result.Error))
+		}
+	}
+	return rows
+}
+
+// InstallFailedError is returned when waiting for a host whose installation failed.
+type InstallFailedError struct {
+	Status api.StatusResponse
+}
+
+func (e *InstallFailedError) Error() string {
+	return fmt.Sprintf("installation of MAC %s failed: %s", e.Status.Macaddress, e.Status.Error)
+}
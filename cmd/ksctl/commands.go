@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"kickstart/api"
+	"kickstart/client"
+	"kickstart/common"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func uploadFlags(fs *flag.FlagSet) func(ctx context.Context, g *globalOptions, args []string) error {
+	quiet := fs.Bool("q", false, "do not report the progress of uploads")
+	return func(ctx context.Context, g *globalOptions, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+		uploaded := []api.UploadResponse{}
+		for _, path := range args {
+			var progress client.ProgressFunc
+			if !*quiet {
+				progress = uploadProgress(path)
+			}
+			response, err := c.UploadISOFile(ctx, path, progress)
+			if progress != nil {
+				fmt.Fprintln(os.Stderr)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to upload %s: %w", path, err)
+			}
+			uploaded = append(uploaded, response)
+			if g.output == "table" {
+				fmt.Printf("uploaded %s\n", response.Filename)
+			}
+		}
+		if g.output == "json" {
+			return printJSON(uploaded)
+		}
+		return nil
+	}
+}
+
+// uploadProgress reports the progress of the upload of path on stderr, once per percent.
+func uploadProgress(path string) client.ProgressFunc {
+	last := int64(-1)
+	return func(sent, total int64) {
+		percent := int64(100)
+		if total > 0 {
+			percent = sent * 100 / total
+		}
+		if percent == last {
+			return
+		}
+		last = percent
+		fmt.Fprintf(os.Stderr, "\r%s: %3d%% of %d bytes", path, percent, total)
+		if sent == total {
+			fmt.Fprint(os.Stderr, ", waiting for the ISO to be extracted")
+		}
+	}
+}
+
+func registerFlags(fs *flag.FlagSet) func(ctx context.Context, g *globalOptions, args []string) error {
+	var ks api.KS
+	file := fs.String("f", "", `YAML file of the hosts to register, a single host or a list, "-" for stdin`)
+	force := fs.Bool("force", false, "replace existing registrations of the same MAC addresses")
+	fs.StringVar(&ks.Macaddress, "mac", "", "MAC address of the PXE NIC")
+	fs.StringVar(&ks.Password, "password", "", "root password, in plain text or as a SHA-512 crypt hash")
+	fs.StringVar(&ks.IP, "ip", "", "IP address of vmk0")
+	fs.StringVar(&ks.Netmask, "netmask", "", "netmask of vmk0")
+	fs.StringVar(&ks.Gateway, "gateway", "", "default gateway")
+	fs.StringVar(&ks.Nameserver, "nameserver", "", "DNS server")
+	fs.StringVar(&ks.Hostname, "hostname", "", "hostname")
+	vlanID := fs.Int("vlanid", 0, "VLAN ID of the management network")
+	fs.Func("cli", "command run after installation, can be repeated", func(value string) error {
+		ks.CLI = append(ks.CLI, value)
+		return nil
+	})
+	fs.Func("secret-cli", "command run after installation and kept secret, can be repeated", func(value string) error {
+		ks.SecretCLI = append(ks.SecretCLI, len(ks.CLI))
+		ks.CLI = append(ks.CLI, value)
+		return nil
+	})
+	fs.StringVar(&ks.Keyboard, "keyboard", "", "keyboard layout")
+	fs.StringVar(&ks.ISOFilename, "iso", "", "file name of the uploaded ISO to install")
+	fs.BoolVar(&ks.NotVmPgCreate, "notvmpgcreate", false, "do not create the VM Network port group")
+	fs.BoolVar(&ks.SecureBoot, "secureboot", false, "boot the installer with secure boot")
+	return func(ctx context.Context, g *globalOptions, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "vlanid" {
+				ks.VLANID = vlanID
+			}
+		})
+		var hosts []api.KS
+		if *file != "" {
+			if ks.Macaddress != "" {
+				return errors.New("hosts are given either with -f or with flags, not both")
+			}
+			var err error
+			hosts, err = readHosts(*file)
+			if err != nil {
+				return err
+			}
+		}
+
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+		if *file == "" {
+			response, err := c.Register(ctx, ks, *force)
+			if err != nil {
+				return fmt.Errorf("failed to register %s: %w", ks.Macaddress, err)
+			}
+			if g.output == "json" {
+				return printJSON([]api.KS{response})
+			}
+			fmt.Printf("registered %s %s\n", response.Macaddress, response.Hostname)
+			return nil
+		}
+
+		// The hosts of a file are registered in one batch, so that a failure leaves none of them registered.
+		response, err := c.RegisterBulk(ctx, hosts, *force)
+		if err != nil {
+			return fmt.Errorf("failed to register the hosts of %s, none was registered: %w", *file, err)
+		}
+		if g.output == "json" {
+			return printJSON(response)
+		}
+		for i, result := range response.Results {
+			fmt.Printf("registered %s %s\n", result.Macaddress, hosts[i].Hostname)
+		}
+		return nil
+	}
+}
+
+// readHosts reads the hosts to register from a YAML file holding either a single host or a list of them.
+// The keys are those of the JSON API.
+func readHosts(path string) ([]api.KS, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if _, isList := document.([]interface{}); isList {
+		var hosts []api.KS
+		if err := yaml.UnmarshalStrict(data, &hosts); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		return hosts, nil
+	}
+	var host api.KS
+	if err := yaml.UnmarshalStrict(data, &host); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return []api.KS{host}, nil
+}
+
+func listFlags(fs *flag.FlagSet) func(ctx context.Context, g *globalOptions, args []string) error {
+	var opts client.ListOptions
+	var phase string
+	fs.StringVar(&opts.Macaddress, "mac", "", "only list the registration of this MAC address")
+	fs.StringVar(&opts.Hostname, "hostname", "", "only list registrations with this hostname")
+	fs.StringVar(&opts.IP, "ip", "", "only list registrations with this PXE or vmk0 IP")
+	fs.StringVar(&opts.ISOFilename, "iso", "", "only list registrations installing this ISO")
+	fs.StringVar(&phase, "phase", "", "only list registrations in this phase")
+	fs.IntVar(&opts.Offset, "offset", 0, "number of registrations to skip")
+	fs.IntVar(&opts.Limit, "limit", 0, "maximum number of registrations to list")
+	return func(ctx context.Context, g *globalOptions, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		opts.Phase = common.Phase(phase)
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+		response, err := c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		if g.output == "json" {
+			return printJSON(response)
+		}
+		rows := [][]string{{"MAC", "HOSTNAME", "VMK0 IP", "PXE IP", "ISO", "PHASE", "CREATED"}}
+		for _, reg := range response.Registrations {
+			rows = append(rows, []string{reg.Macaddress, reg.Hostname, reg.VMKIP, reg.IP, reg.ISOFilename, string(reg.Phase), reg.CreatedAt.Local().Format(time.RFC3339)})
+		}
+		printTable(rows)
+		if shown := response.Offset + len(response.Registrations); shown < response.Total {
+			fmt.Fprintf(os.Stderr, "%d of %d registrations shown, use -offset to see the others\n", len(response.Registrations), response.Total)
+		}
+		return nil
+	}
+}
+
+func deleteFlags(fs *flag.FlagSet) func(ctx context.Context, g *globalOptions, args []string) error {
+	return func(ctx context.Context, g *globalOptions, args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+		for _, mac := range args {
+			if err := c.Delete(ctx, mac); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", mac, err)
+			}
+			if g.output == "table" {
+				fmt.Printf("deleted %s\n", mac)
+			}
+		}
+		if g.output == "json" {
+			return printJSON(map[string][]string{"deleted": args})
+		}
+		return nil
+	}
+}
+
+func versionsFlags(fs *flag.FlagSet) func(ctx context.Context, g *globalOptions, args []string) error {
+	return func(ctx context.Context, g *globalOptions, args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+		response, err := c.ESXiVersions(ctx)
+		if err != nil {
+			return err
+		}
+		if g.output == "json" {
+			return printJSON(response)
+		}
+		filenames := make([]string, 0, len(response.UploadedFiles))
+		for filename := range response.UploadedFiles {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+		rows := [][]string{{"ISO", "VERSION"}}
+		for _, filename := range filenames {
+			rows = append(rows, []string{filename, response.UploadedFiles[filename]})
+		}
+		printTable(rows)
+		return nil
+	}
+}
+
+func statusFlags(fs *flag.FlagSet) func(ctx context.Context, g *globalOptions, args []string) error {
+	follow := fs.Bool("f", false, "follow the installation until it completes or fails, printing each phase reached")
+	interval := fs.Duration("interval", 5*time.Second, "how often to poll the status when following")
+	return func(ctx context.Context, g *globalOptions, args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+		if *follow {
+			return followStatus(ctx, c, g, args[0], *interval)
+		}
+		status, err := c.Status(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if g.output == "json" {
+			return printJSON(status)
+		}
+		printTable([][]string{
+			{"MAC", "PXE IP", "ISO", "PHASE", "ERROR"},
+			{status.Macaddress, status.IP, status.ISOFilename, string(status.Phase), status.Error},
+		})
+		fmt.Println()
+		printHistory(status.History)
+		return nil
+	}
+}
+
+// followStatus polls the status of mac and prints the phases it reaches, until its installation completes or fails.
+// With JSON output, each new phase is printed as a JSON line.
+// A registration deleted after the host fetched its ks.cfg was cleaned up on completion, see client.WaitForCompletion.
+func followStatus(ctx context.Context, c *client.Client, g *globalOptions, mac string, interval time.Duration) error {
+	printed := 0
+	var last common.Phase
+	for {
+		wait := interval
+		status, err := c.Status(ctx, mac)
+		var apiErr *client.Error
+		switch {
+		case errors.As(err, &apiErr) && errors.Is(err, client.ErrRateLimited):
+			if apiErr.RetryAfter > wait {
+				wait = apiErr.RetryAfter
+			}
+		case errors.Is(err, client.ErrNotFound) && last.Reached(common.PhaseKsFetched):
+			fmt.Fprintf(os.Stderr, "registration of %s was deleted on completion\n", mac)
+			return nil
+		case err != nil:
+			return err
+		default:
+			// The history starts over when the host is registered again.
+			if len(status.History) < printed {
+				printed = 0
+			}
+			for _, transition := range status.History[printed:] {
+				if g.output == "json" {
+					if err := printJSON(transition); err != nil {
+						return err
+					}
+				} else {
+					printHistory([]common.PhaseTransition{transition})
+				}
+			}
+			printed = len(status.History)
+			last = status.Phase
+			switch status.Phase {
+			case common.PhaseCompleted:
+				return nil
+			case common.PhaseFailed:
+				return &client.InstallFailedError{Status: status}
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func printHistory(history []common.PhaseTransition) {
+	for _, transition := range history {
+		fmt.Printf("%s  %s\n", transition.At.Local().Format(time.RFC3339), transition.Phase)
+	}
+}
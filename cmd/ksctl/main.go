@@ -0,0 +1,155 @@
+// Command ksctl manages a kickstart server from the command line: it uploads ESXi ISOs, registers hosts and follows their installation.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"kickstart/client"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+const usage = `Usage: ksctl <command> [flags] [arguments]
+
+Commands:
+  upload    upload ESXi ISOs or offline depot zips
+  register  register hosts from flags or a YAML file
+  list      list registrations
+  delete    delete registrations
+  versions  show the ESXi version of each uploaded ISO
+  status    show or follow the installation status of a host
+
+Run "ksctl <command> -h" for the flags of a command.
+The server and credentials are taken from KSCTL_SERVER, KSCTL_TOKEN, KSCTL_USER and KSCTL_CA_CERT unless given as flags.
+`
+
+// command is a subcommand of ksctl, run with the arguments left once its flags are parsed.
+type command struct {
+	name  string
+	args  string
+	flags func(fs *flag.FlagSet) func(ctx context.Context, g *globalOptions, args []string) error
+}
+
+var commands = []command{
+	{"upload", "<file>...", uploadFlags},
+	{"register", "", registerFlags},
+	{"list", "", listFlags},
+	{"delete", "<mac>...", deleteFlags},
+	{"versions", "", versionsFlags},
+	{"status", "<mac>", statusFlags},
+}
+
+// errUsage tells main that the command was misused and its usage was already printed.
+var errUsage = errors.New("usage")
+
+// globalOptions are the flags shared by every command.
+type globalOptions struct {
+	server string
+	token  string
+	user   string
+	caCert string
+	output string
+}
+
+func (g *globalOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.server, "server", envOr("KSCTL_SERVER", "http://127.0.0.1"), "URL of the management API, such as https://192.168.0.10:8080")
+	fs.StringVar(&g.token, "token", os.Getenv("KSCTL_TOKEN"), "bearer token")
+	fs.StringVar(&g.user, "user", os.Getenv("KSCTL_USER"), "basic auth credentials as username:password")
+	fs.StringVar(&g.caCert, "ca-cert", os.Getenv("KSCTL_CA_CERT"), "PEM file of the CA to trust, such as the ca.crt of a server using a self-signed certificate")
+	fs.StringVar(&g.output, "o", "table", "output format, table or json")
+}
+
+// client returns a client of the server given by g.
+func (g *globalOptions) client() (*client.Client, error) {
+	if g.output != "table" && g.output != "json" {
+		return nil, fmt.Errorf("unknown output format %q, expected table or json", g.output)
+	}
+	c, err := client.New(g.server)
+	if err != nil {
+		return nil, err
+	}
+	c.Token = g.token
+	if g.user != "" {
+		username, password, found := strings.Cut(g.user, ":")
+		if !found {
+			return nil, errors.New("user must be given as username:password")
+		}
+		c.Username, c.Password = username, password
+	}
+	if g.caCert != "" {
+		pem, err := os.ReadFile(g.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", g.caCert)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		c.HTTPClient = &http.Client{Transport: transport}
+	}
+	return c, nil
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(os.Stderr, usage)
+		if len(args) == 0 {
+			return errUsage
+		}
+		return nil
+	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: ksctl %s [flags] %s\n\nFlags:\n", cmd.name, cmd.args)
+			fs.PrintDefaults()
+		}
+		g := &globalOptions{}
+		g.register(fs)
+		runCommand := cmd.flags(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil
+			}
+			return errUsage
+		}
+		err := runCommand(ctx, g, fs.Args())
+		if errors.Is(err, errUsage) {
+			fs.Usage()
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "ksctl: unknown command %q\n\n%s", args[0], usage)
+	return errUsage
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := run(ctx, os.Args[1:])
+	stop()
+	switch {
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "ksctl: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"kickstart/config"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+// Client system architectures sent in DHCP option 93 that the DHCP server answers.
+const (
+	ArchBIOS     uint16 = 0
+	ArchUEFIIA32 uint16 = 6
+	ArchUEFIX64  uint16 = 7
+	ArchUEFIBC   uint16 = 9
+	ArchUEFIHTTP uint16 = 16
+)
+
+// installerHost returns the host of the installer URLs handed out to UEFI HTTP Boot clients.
+// The port is left out when it is the default one of the scheme.
+func installerHost(cfg *config.Config) string {
+	defaultPort := 80
+	if cfg.TLSEnabled {
+		defaultPort = 443
+	}
+	if cfg.BootServerPort != defaultPort {
+		return net.JoinHostPort(cfg.ServicePortAddr.String(), strconv.Itoa(cfg.BootServerPort))
+	}
+	return cfg.ServicePortAddr.String()
+}
+
+// BootFilename returns the boot filename that DHCP hands out to a host installing isoFilename,
+// given its client system architecture and whether it already runs iPXE.
+// It returns false for architectures that are not supported.
+func BootFilename(cfg *config.Config, isoFilename string, arch uint16, iPXE bool) (string, bool) {
+	switch arch {
+	case ArchBIOS:
+		if iPXE {
+			return filepath.Join(isoFilename, "pxelinux.0"), true
+		}
+		return filepath.Join(isoFilename, "undionly.kpxe"), true
+	case ArchUEFIIA32, ArchUEFIX64, ArchUEFIBC:
+		if iPXE {
+			return filepath.Join(isoFilename, "mboot.efi"), true
+		}
+		return filepath.Join(isoFilename, "ipxe.efi"), true
+	case ArchUEFIHTTP:
+		url := &url.URL{
+			Scheme: config.InstallerScheme(cfg),
+			Host:   installerHost(cfg),
+			Path:   filepath.Join("installer", isoFilename, "mboot.efi"),
+		}
+		return url.String(), true
+	}
+	return "", false
+}
@@ -4,18 +4,21 @@ import (
 	"embed"
 	"encoding/xml"
 	"io/fs"
-	"net"
+	"kickstart/config"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
+	"text/template"
 )
 
 var (
-	MacIPMap               = make(map[string]net.IP)
-	MacIPMapMutex          sync.RWMutex
-	MacFileMap             = make(map[string]string)
-	MacFileMapMutex        sync.RWMutex
 	MacAddressManagerMutex sync.Mutex
 	MbootMutex             sync.RWMutex
 	IsoFileUploadMutex     sync.RWMutex
+	// RegistrationMutex serializes registrations so that conflicts between them are detected.
+	RegistrationMutex sync.Mutex
 )
 
 var (
@@ -49,15 +52,51 @@ type YamlProduct struct {
 }
 
 type BootCfgTemplateData struct {
-	KSServerAddr string
-	KSServerPort string
-	Filename     string
+	KSServerScheme string
+	KSServerAddr   string
+	KSServerPort   string
+	Filename       string
+	// KSPath follows /ks in the ks URL. It holds the ks token of the host, or nothing if the host is not known,
+	// in which case the ks.cfg is looked up by the IP of the installer.
+	KSPath string
 }
 
-func LoadBootCfgTemplateData(KSServerAddr, KSServerPort, Filename string) *BootCfgTemplateData {
+func LoadBootCfgTemplateData(KSServerScheme, KSServerAddr, KSServerPort, Filename, KSPath string) *BootCfgTemplateData {
 	return &BootCfgTemplateData{
-		KSServerAddr: KSServerAddr,
-		KSServerPort: KSServerPort,
-		Filename:     Filename,
+		KSServerScheme: KSServerScheme,
+		KSServerAddr:   KSServerAddr,
+		KSServerPort:   KSServerPort,
+		Filename:       Filename,
+		KSPath:         KSPath,
 	}
+}
+
+// KSPath returns the KSPath of the boot.cfg served to the host registered for mac.
+func KSPath(store *Store, cfg *config.Config, mac string) (string, error) {
+	if mac == "" {
+		return "", nil
+	}
+	token, err := store.KSToken(mac, cfg.KSTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	return "/" + token, nil
+}
+
+// legacyKsURL matches the kernelopt line of boot.cfg files extracted by older versions.
+var legacyKsURL = regexp.MustCompile(`(?m)^(kernelopt=.*\{\{\.KSServerPort\}\}/ks)$`)
+
+// ParseBootCfgTemplate parses the boot.cfg template at path.
+// The boot.cfg files extracted by older versions have the http scheme written in them and no KSPath,
+// which are replaced by the scheme in use and added.
+func ParseBootCfgTemplate(path string) (*template.Template, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.Replace(string(content), "http://{{.KSServerAddr}}", "{{.KSServerScheme}}://{{.KSServerAddr}}", -1)
+	if !strings.Contains(text, "{{.KSPath}}") {
+		text = legacyKsURL.ReplaceAllString(text, "${1}{{.KSPath}}")
+	}
+	return template.New(filepath.Base(path)).Parse(text)
 }
\ No newline at end of file
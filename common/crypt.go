@@ -0,0 +1,200 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SHA-512 crypt as specified in https://www.akkadia.org/drepper/SHA-crypt.txt, which is what rootpw --iscrypted takes.
+const (
+	sha512CryptPrefix        = "$6$"
+	sha512CryptRoundsPrefix  = "rounds="
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSaltLength = 16
+	cryptAlphabet            = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// sha512CryptByteOrder is the order in which the bytes of the final digest are encoded, three at a time.
+var sha512CryptByteOrder = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+var errInvalidCrypt = errors.New("invalid SHA-512 crypt hash")
+
+// sha512CryptSetting is the part of a SHA-512 crypt hash that is fed to the algorithm.
+type sha512CryptSetting struct {
+	salt string
+	// rounds is zero when the hash leaves it out and the default applies.
+	rounds int
+	hash   string
+}
+
+func parseSHA512Crypt(s string) (sha512CryptSetting, error) {
+	if !strings.HasPrefix(s, sha512CryptPrefix) {
+		return sha512CryptSetting{}, errInvalidCrypt
+	}
+	parts := strings.Split(strings.TrimPrefix(s, sha512CryptPrefix), "$")
+	var setting sha512CryptSetting
+	if strings.HasPrefix(parts[0], sha512CryptRoundsPrefix) {
+		rounds, err := strconv.Atoi(strings.TrimPrefix(parts[0], sha512CryptRoundsPrefix))
+		if err != nil || rounds < sha512CryptMinRounds || rounds > sha512CryptMaxRounds {
+			return sha512CryptSetting{}, errInvalidCrypt
+		}
+		setting.rounds = rounds
+		parts = parts[1:]
+	}
+	if len(parts) != 2 {
+		return sha512CryptSetting{}, errInvalidCrypt
+	}
+	setting.salt, setting.hash = parts[0], parts[1]
+	if setting.salt == "" || len(setting.salt) > sha512CryptMaxSaltLength || len(setting.hash) != 86 {
+		return sha512CryptSetting{}, errInvalidCrypt
+	}
+	for _, c := range setting.salt + setting.hash {
+		if !strings.ContainsRune(cryptAlphabet, c) {
+			return sha512CryptSetting{}, errInvalidCrypt
+		}
+	}
+	return setting, nil
+}
+
+// IsSHA512Crypt tells whether s is a SHA-512 crypt hash such as $6$salt$hash.
+func IsSHA512Crypt(s string) bool {
+	_, err := parseSHA512Crypt(s)
+	return err == nil
+}
+
+// repeatBytes returns the first n bytes of b repeated as many times as needed.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:minInt(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// sha512Crypt hashes password with salt, using the default number of rounds when rounds is zero.
+func sha512Crypt(password, salt string, rounds int) string {
+	p, s := []byte(password), []byte(salt)
+	effectiveRounds := rounds
+	if effectiveRounds == 0 {
+		effectiveRounds = sha512CryptDefaultRounds
+	}
+
+	b := sha512.New()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	digestB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	a.Write(repeatBytes(digestB, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(p)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := sha512.New()
+	for i := 0; i < len(p); i++ {
+		dp.Write(p)
+	}
+	pSeq := repeatBytes(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatBytes(ds.Sum(nil), len(s))
+
+	c := digestA
+	for i := 0; i < effectiveRounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512CryptPrefix)
+	if rounds != 0 {
+		out.WriteString(fmt.Sprintf("%s%d$", sha512CryptRoundsPrefix, rounds))
+	}
+	out.WriteString(salt)
+	out.WriteString("$")
+	encode := func(v uint32, n int) {
+		for i := 0; i < n; i++ {
+			out.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, order := range sha512CryptByteOrder {
+		encode(uint32(c[order[0]])<<16|uint32(c[order[1]])<<8|uint32(c[order[2]]), 4)
+	}
+	encode(uint32(c[63]), 2)
+	return out.String()
+}
+
+// HashPassword returns the SHA-512 crypt hash of password with a random salt.
+// A password that already is a SHA-512 crypt hash is returned as is.
+func HashPassword(password string) (string, error) {
+	if IsSHA512Crypt(password) {
+		return password, nil
+	}
+	random := make([]byte, sha512CryptMaxSaltLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	salt := make([]byte, len(random))
+	for i, b := range random {
+		salt[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+	return sha512Crypt(password, string(salt), 0), nil
+}
+
+// VerifyPassword tells whether password matches hash, or equals it when hash is not a SHA-512 crypt hash.
+func VerifyPassword(password, hash string) bool {
+	if password == hash {
+		return true
+	}
+	setting, err := parseSHA512Crypt(hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sha512Crypt(password, setting.salt, setting.rounds)), []byte(hash)) == 1
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+// The SHA-512 test vectors of https://www.akkadia.org/drepper/SHA-crypt.txt.
+// The salts are given truncated to 16 characters and the rounds raised to the minimum, as the specification does.
+var sha512CryptVectors = []struct {
+	salt     string
+	rounds   int
+	password string
+	want     string
+}{
+	{"saltstring", 0, "Hello world!",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+	{"saltstringsaltst", 10000, "Hello world!",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+	{"toolongsaltstrin", 5000, "This is just a test",
+		"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	{"anotherlongsalts", 1400, "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+		"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+	{"short", 77777, "we have a short salt string but not a short password",
+		"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	{"asaltof16chars..", 123456, "a short string",
+		"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+	{"roundstoolow", 1000, "the minimum number is still observed",
+		"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+}
+
+func TestSHA512Crypt(t *testing.T) {
+	for _, tt := range sha512CryptVectors {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := sha512Crypt(tt.password, tt.salt, tt.rounds); got != tt.want {
+				t.Errorf("sha512Crypt() = %s, want %s", got, tt.want)
+			}
+			if !IsSHA512Crypt(tt.want) {
+				t.Errorf("IsSHA512Crypt(%s) = false", tt.want)
+			}
+			if !VerifyPassword(tt.password, tt.want) {
+				t.Errorf("VerifyPassword() = false for the password of %s", tt.want)
+			}
+			if VerifyPassword(tt.password+"x", tt.want) {
+				t.Errorf("VerifyPassword() = true for another password than the one of %s", tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSHA512Crypt(t *testing.T) {
+	hash := sha512CryptVectors[0].want
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{"hash", hash, true},
+		{"hash with rounds", sha512CryptVectors[1].want, true},
+		{"plain text", "VMware1!", false},
+		{"MD5 crypt", "$1$saltstri$YMyguxXMBpd2TEZ.vS/3q1", false},
+		{"no salt", "$6$$" + strings.TrimPrefix(hash, "$6$saltstring$"), false},
+		{"salt too long", "$6$saltstringsaltstr$" + strings.TrimPrefix(hash, "$6$saltstring$"), false},
+		{"hash too short", hash[:len(hash)-1], false},
+		{"invalid character", hash[:len(hash)-1] + "!", false},
+		{"rounds too low", "$6$rounds=10$" + strings.TrimPrefix(hash, "$6$"), false},
+		{"rounds not a number", "$6$rounds=many$" + strings.TrimPrefix(hash, "$6$"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsSHA512Crypt(tt.s); got != tt.want {
+				t.Errorf("IsSHA512Crypt(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("VMware1!")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	if !IsSHA512Crypt(hash) || !VerifyPassword("VMware1!", hash) {
+		t.Errorf("HashPassword() = %s, want a SHA-512 crypt hash of the password", hash)
+	}
+	if other, _ := HashPassword("VMware1!"); other == hash {
+		t.Errorf("HashPassword() returned %s twice, want a random salt", hash)
+	}
+	// A password given as a hash is kept.
+	if again, _ := HashPassword(hash); again != hash {
+		t.Errorf("HashPassword(%s) = %s, want it unchanged", hash, again)
+	}
+}
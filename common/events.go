@@ -0,0 +1,116 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventDHCPOffer           EventType = "dhcp_offer"
+	EventDHCPAck             EventType = "dhcp_ack"
+	EventTFTPFileServed      EventType = "tftp_file_served"
+	EventInstallerFileServed EventType = "installer_file_served"
+	EventKsFetched           EventType = "ks_fetched"
+	EventRegistered          EventType = "registered"
+	EventUpdated             EventType = "updated"
+	EventDeleted             EventType = "deleted"
+	EventCompleted           EventType = "completed"
+	EventFailed              EventType = "failed"
+)
+
+var eventTypes = []EventType{
+	EventDHCPOffer,
+	EventDHCPAck,
+	EventTFTPFileServed,
+	EventInstallerFileServed,
+	EventKsFetched,
+	EventRegistered,
+	EventUpdated,
+	EventDeleted,
+	EventCompleted,
+	EventFailed,
+}
+
+// Valid tells whether t is one of the events raised by the server.
+func (t EventType) Valid() bool {
+	for _, eventType := range eventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is something that happened to a host while it was being served.
+type Event struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	Macaddress string    `json:"macaddress,omitempty"`
+	Hostname   string    `json:"hostname,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// eventBufferSize is how many events a subscriber can fall behind before events are dropped for it.
+const eventBufferSize = 64
+
+// EventBus fans out the events raised by the DHCP, TFTP and API servers to its subscribers.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[chan Event]struct{}
+	store       *Store
+}
+
+func NewEventBus(store *Store) *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]struct{}),
+		store:       store,
+	}
+}
+
+// Publish sends event to every subscriber, filling in what the store knows about the host.
+// Subscribers that are not keeping up miss the event rather than blocking the publisher.
+func (b *EventBus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Macaddress != "" {
+		if reg, ok := b.store.Get(event.Macaddress); ok {
+			if event.Hostname == "" {
+				event.Hostname = reg.Hostname
+			}
+			if event.IP == "" && reg.IP != nil {
+				event.IP = reg.IP.String()
+			}
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving published events and a function to stop receiving them.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+		})
+	}
+}
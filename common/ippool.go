@@ -0,0 +1,146 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"kickstart/config"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/mdlayher/arp"
+)
+
+var ErrNoAvailableIP = errors.New("any IPs available in the specified range")
+
+// AssignIP returns the IP address of a registered MAC address, taking a free one from the DHCP range if it has none.
+// The second return value reports whether a new IP address was assigned.
+func (s *Store) AssignIP(mac string, dhcpConfig *config.DHCPLeaseConfig) (net.IP, bool, error) {
+	MacAddressManagerMutex.Lock()
+	defer MacAddressManagerMutex.Unlock()
+
+	ip, ok := s.IP(mac)
+	if ok {
+		return ip, false, nil
+	}
+
+	availableIP := FindAvailableIP(s.UsedIPs(), dhcpConfig)
+	if availableIP == nil {
+		return nil, false, ErrNoAvailableIP
+	}
+	err := s.Update(mac, func(reg *Registration) error {
+		reg.IP = availableIP
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return availableIP, true, nil
+}
+
+// AssignIPs is AssignIP for several MAC addresses at once, applying fn to each registration in the same batch.
+// Either every MAC address gets an IP address or none does.
+func (s *Store) AssignIPs(macs []string, dhcpConfig *config.DHCPLeaseConfig, fn func(i int, reg *Registration) error) error {
+	MacAddressManagerMutex.Lock()
+	defer MacAddressManagerMutex.Unlock()
+
+	usedIPs := s.UsedIPs()
+	available := make(map[string]net.IP)
+	for _, mac := range macs {
+		if _, ok := usedIPs[mac]; ok {
+			continue
+		}
+		if _, ok := available[mac]; ok {
+			continue
+		}
+		ip := FindAvailableIP(usedIPs, dhcpConfig)
+		if ip == nil {
+			return ErrNoAvailableIP
+		}
+		available[mac] = ip
+		usedIPs[mac] = ip
+	}
+
+	return s.UpsertBatch(macs, func(i int, reg *Registration) error {
+		if err := fn(i, reg); err != nil {
+			return err
+		}
+		if reg.IP == nil {
+			reg.IP = available[reg.Macaddress]
+		}
+		return nil
+	})
+}
+
+func FindAvailableIP(usedIPs map[string]net.IP, dhcpConfig *config.DHCPLeaseConfig) net.IP {
+	start := IPToInt(dhcpConfig.DHCPStartIP)
+	end := IPToInt(dhcpConfig.DHCPEndIP)
+
+	used := make(map[uint32]bool)
+	for _, ip := range usedIPs {
+		used[IPToInt(ip)] = true
+	}
+
+	for i := start; i <= end; i++ {
+		if !used[i] {
+			ip := intToIP(i)
+			if !isIPUsed(ip, dhcpConfig.DHCPInterfaceName) {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+// IPToInt returns the IPv4 address ip as an integer.
+func IPToInt(ip net.IP) uint32 {
+	ipv4Int := binary.BigEndian.Uint32(ip.To4())
+	return ipv4Int
+}
+
+func intToIP(ipInt uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, ipInt)
+	return ip
+}
+
+func isIPUsed(searchIP net.IP, servicePortName string) bool {
+	// Ensure valid network interface
+	ifi, err := net.InterfaceByName(servicePortName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Check if the interface itself has the IP
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, addr := range addrs {
+		// Check if the address is the one we're searching for
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(searchIP) {
+			return true
+		}
+	}
+
+	// Set up ARP client with socket
+	c, err := arp.Dial(ifi)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	// Set request deadline
+	if err := c.SetDeadline(time.Now().Add(1 * time.Second)); err != nil {
+		log.Fatal(err)
+	}
+
+	// Request hardware address for IP address
+	ip, err := netip.ParseAddr(searchIP.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = c.Resolve(ip)
+	return err == nil
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Journal is an append-only file of JSON lines used to persist server state across restarts.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// appended counts the entries appended since the journal was opened or last compacted.
+	appended int
+}
+
+func OpenJournal(path string) (*Journal, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	err = repairTail(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to repair journal: %w", err)
+	}
+	return &Journal{path: path, file: file}, nil
+}
+
+// repairTail makes sure the journal ends with a complete line, so that the next entry is not appended to a torn one.
+// A torn last line is truncated, and a last line missing only its newline is given one.
+func repairTail(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil
+	}
+
+	// Look for the start of the last line, reading backwards.
+	end := size
+	chunk := make([]byte, 64*1024)
+	lineStart := int64(0)
+	var tail []byte
+	for end > 0 {
+		start := end - int64(len(chunk))
+		if start < 0 {
+			start = 0
+		}
+		buf := chunk[:end-start]
+		_, err = file.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if end == size && buf[len(buf)-1] == '\n' {
+			return nil
+		}
+		tail = append(append([]byte{}, buf...), tail...)
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			lineStart = start + int64(i) + 1
+			tail = tail[i+1:]
+			break
+		}
+		end = start
+	}
+
+	if json.Valid(tail) {
+		_, err = file.Write([]byte{'\n'})
+	} else {
+		err = file.Truncate(lineStart)
+	}
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Replay calls fn for every entry in the journal in the order they were written.
+// A torn last line, left behind by a crash in the middle of a write, is ignored; OpenJournal removes it.
+func (j *Journal) Replay(fn func(entry json.RawMessage) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var pending []byte
+	for scanner.Scan() {
+		if pending != nil {
+			return fmt.Errorf("corrupted journal entry: %s", pending)
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			pending = append([]byte{}, line...)
+			continue
+		}
+		err = fn(json.RawMessage(line))
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Append writes an entry to the end of the journal and flushes it to disk.
+func (j *Journal) Append(entry interface{}) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entry: %w", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.file.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write journal entry: %w", err)
+	}
+	j.appended++
+	return j.file.Sync()
+}
+
+// Appended returns how many entries were appended since the journal was opened or last compacted.
+func (j *Journal) Appended() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.appended
+}
+
+// Compact atomically replaces the journal with the given entries.
+func (j *Journal) Compact(entries []interface{}) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create journal: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to marshal journal entry: %w", err)
+		}
+		writer.Write(append(data, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	err = os.Rename(tmpPath, j.path)
+	if err != nil {
+		return fmt.Errorf("failed to replace journal: %w", err)
+	}
+	file, err := os.OpenFile(j.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen journal: %w", err)
+	}
+	j.file.Close()
+	j.file = file
+	j.appended = 0
+	return nil
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	N int `json:"n"`
+}
+
+// replayAll returns the raw entries of j.
+func replayAll(t *testing.T, j *Journal) []string {
+	t.Helper()
+	var entries []string
+	err := j.Replay(func(entry json.RawMessage) error {
+		entries = append(entries, string(entry))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	return entries
+}
+
+func TestOpenJournalRepairsTail(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantFile string
+	}{
+		{"empty", "", ""},
+		{"complete", "{\"n\":1}\n{\"n\":2}\n", "{\"n\":1}\n{\"n\":2}\n"},
+		{"torn last line", "{\"n\":1}\n{\"n\":", "{\"n\":1}\n"},
+		{"torn only line", "{\"n\"", ""},
+		{"missing newline", "{\"n\":1}\n{\"n\":2}", "{\"n\":1}\n{\"n\":2}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			j, err := OpenJournal(path)
+			if err != nil {
+				t.Fatalf("OpenJournal() error = %v", err)
+			}
+			defer j.Close()
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantFile {
+				t.Errorf("journal = %q, want %q", data, tt.wantFile)
+			}
+
+			// The next entry must start on a line of its own.
+			if err := j.Append(testEntry{N: 3}); err != nil {
+				t.Fatalf("Append() error = %v", err)
+			}
+			entries := replayAll(t, j)
+			if len(entries) == 0 || entries[len(entries)-1] != `{"n":3}` {
+				t.Errorf("Replay() = %q, want it to end with the appended entry", entries)
+			}
+		})
+	}
+}
+
+func TestOpenJournalRepairsLongTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	long := make([]byte, 200*1024)
+	for i := range long {
+		long[i] = 'a'
+	}
+	content := "{\"n\":1}\n{\"s\":\"" + string(long)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal() error = %v", err)
+	}
+	defer j.Close()
+	if entries := replayAll(t, j); len(entries) != 1 || entries[0] != `{"n":1}` {
+		t.Errorf("Replay() = %q, want only the complete entry", entries)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"in order", "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n", []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}, false},
+		{"blank lines", "{\"n\":1}\n\n{\"n\":2}\n", []string{`{"n":1}`, `{"n":2}`}, false},
+		{"torn last line", "{\"n\":1}\n{\"n\":", []string{`{"n":1}`}, false},
+		{"corrupted line in the middle", "{\"n\":1}\n{\"n\":\n{\"n\":3}\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The file is written after the journal is opened so that Replay sees it as is.
+			path := filepath.Join(t.TempDir(), "journal")
+			j, err := OpenJournal(path)
+			if err != nil {
+				t.Fatalf("OpenJournal() error = %v", err)
+			}
+			defer j.Close()
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			var entries []string
+			err = j.Replay(func(entry json.RawMessage) error {
+				entries = append(entries, string(entry))
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Replay() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if strings.Join(entries, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Replay() = %q, want %q", entries, tt.want)
+			}
+		})
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  []testEntry
+		compact []testEntry
+		after   []testEntry
+		want    []string
+	}{
+		{"replaces entries", []testEntry{{1}, {2}, {3}}, []testEntry{{3}}, nil, []string{`{"n":3}`}},
+		{"empties the journal", []testEntry{{1}}, nil, nil, nil},
+		{"appends after compaction", []testEntry{{1}, {2}}, []testEntry{{2}}, []testEntry{{4}}, []string{`{"n":2}`, `{"n":4}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal")
+			j, err := OpenJournal(path)
+			if err != nil {
+				t.Fatalf("OpenJournal() error = %v", err)
+			}
+			for _, entry := range tt.before {
+				if err := j.Append(entry); err != nil {
+					t.Fatalf("Append() error = %v", err)
+				}
+			}
+			entries := make([]interface{}, len(tt.compact))
+			for i, entry := range tt.compact {
+				entries[i] = entry
+			}
+			if err := j.Compact(entries); err != nil {
+				t.Fatalf("Compact() error = %v", err)
+			}
+			for _, entry := range tt.after {
+				if err := j.Append(entry); err != nil {
+					t.Fatalf("Append() error = %v", err)
+				}
+			}
+			j.Close()
+
+			// What was compacted and appended must survive reopening the journal.
+			reopened, err := OpenJournal(path)
+			if err != nil {
+				t.Fatalf("OpenJournal() error = %v", err)
+			}
+			defer reopened.Close()
+			got := replayAll(t, reopened)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Replay() = %q, want %q", got, tt.want)
+			}
+			if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("temporary file of the compaction is left behind")
+			}
+		})
+	}
+}
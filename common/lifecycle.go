@@ -0,0 +1,104 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Phase is a step of the installation of a registered host.
+type Phase string
+
+const (
+	PhaseRegistered Phase = "registered"
+	PhaseOffered    Phase = "offered"
+	PhaseAcked      Phase = "acked"
+	PhaseBootloader Phase = "bootloader"
+	PhaseBootCfg    Phase = "boot.cfg"
+	PhaseKsFetched  Phase = "ks_fetched"
+	PhaseCompleted  Phase = "completed"
+	PhaseFailed     Phase = "failed"
+)
+
+var phaseOrder = map[Phase]int{
+	PhaseRegistered: 0,
+	PhaseOffered:    1,
+	PhaseAcked:      2,
+	PhaseBootloader: 3,
+	PhaseBootCfg:    4,
+	PhaseKsFetched:  5,
+	PhaseCompleted:  6,
+	PhaseFailed:     6,
+}
+
+// Reached tells whether an installation at phase p has got as far as phase other.
+// Failed counts as reaching completed, as the installation is over either way.
+func (p Phase) Reached(other Phase) bool {
+	current, ok := phaseOrder[p]
+	return ok && current >= phaseOrder[other]
+}
+
+type PhaseTransition struct {
+	Phase Phase     `json:"phase"`
+	At    time.Time `json:"at"`
+}
+
+type Lifecycle struct {
+	Phase   Phase             `json:"phase"`
+	Error   string            `json:"error,omitempty"`
+	History []PhaseTransition `json:"history"`
+}
+
+// errUnchanged tells Store.apply that there is nothing to write.
+var errUnchanged = errors.New("registration unchanged")
+
+// Transition moves the lifecycle of mac forward to phase and returns whether it moved.
+// Transitions that would move it backwards, such as the DHCP requests of the installer itself, are ignored.
+// A registration, or a new DHCP offer to a failed host, starts the lifecycle over.
+func (s *Store) Transition(mac string, phase Phase) (bool, error) {
+	moved := false
+	err := s.Update(mac, func(reg *Registration) error {
+		current := reg.Lifecycle.Phase
+		restart := phase == PhaseRegistered || (current == PhaseFailed && phase == PhaseOffered)
+		// The installer reporting completion overrides an earlier failure.
+		recovered := current == PhaseFailed && phase == PhaseCompleted
+		if !restart && !recovered && current != "" && phaseOrder[phase] <= phaseOrder[current] {
+			return errUnchanged
+		}
+		if restart {
+			reg.Lifecycle = Lifecycle{}
+		}
+		reg.Lifecycle.Error = ""
+		reg.Lifecycle.Phase = phase
+		reg.Lifecycle.History = append(reg.Lifecycle.History, PhaseTransition{Phase: phase, At: time.Now()})
+		moved = true
+		return nil
+	})
+	return moved, err
+}
+
+// TransitionByIP moves the lifecycle of the host holding ip forward to phase.
+func (s *Store) TransitionByIP(ip net.IP, phase Phase) (string, bool, error) {
+	mac, ok := s.MacByIP(ip)
+	if !ok {
+		return "", false, ErrRegistrationNotFound
+	}
+	moved, err := s.Transition(mac, phase)
+	return mac, moved, err
+}
+
+// Fail marks the installation of mac as failed with reason and returns whether it was not marked yet.
+func (s *Store) Fail(mac, reason string) (bool, error) {
+	failed := false
+	err := s.Update(mac, func(reg *Registration) error {
+		if reg.Lifecycle.Phase == PhaseCompleted || reg.Lifecycle.Phase == PhaseFailed {
+			return errUnchanged
+		}
+		reg.Lifecycle.Phase = PhaseFailed
+		reg.Lifecycle.Error = reason
+		reg.Lifecycle.History = append(reg.Lifecycle.History, PhaseTransition{Phase: PhaseFailed, At: time.Now()})
+		failed = true
+		return nil
+	})
+	return failed, err
+}
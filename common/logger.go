@@ -23,7 +23,9 @@ func NewLogger(ctx context.Context, logfilepath string) (*zap.Logger, error) {
 		},
 	}
 
-	logger, err := cfg.Build()
+	logger, err := cfg.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return redactingCore{core}
+	}))
 	if err != nil {
 		return nil, err
 	}
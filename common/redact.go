@@ -0,0 +1,72 @@
+package common
+
+import (
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RedactedValue replaces secrets in API responses, the audit log and the log output.
+const RedactedValue = "********"
+
+// secretAssignment matches a password-like option and its value in a CLI command or a ks.cfg,
+// e.g. --password=VMware1!, --password 'VMware1!' or password=VMware1!.
+// Only these explicit forms are matched, so that prose such as "reset the ks token of ..." is left alone.
+var secretAssignment = regexp.MustCompile(`(?i)((?:^|\s)--?[\w-]*(?:password|passwd|secret|token)[\w-]*(?:=|\s+)|\b[\w-]*(?:password|passwd|secret|token)[\w-]*\s*=\s*)("[^"]*"|'[^']*'|[^\s"']+)`)
+
+// IsSecretKey tells whether a field named key holds a password-like value.
+func IsSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"password", "passwd", "secret", "token"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactString masks the values given to password-like options in s.
+func RedactString(s string) string {
+	return secretAssignment.ReplaceAllString(s, "${1}"+RedactedValue)
+}
+
+// redactingCore masks secrets in the fields of log entries before handing them to the wrapped core.
+// Messages are free text and are written as they are.
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch {
+		case IsSecretKey(field.Key):
+			field = zap.String(field.Key, RedactedValue)
+		case field.Type == zapcore.StringType:
+			field.String = RedactString(field.String)
+		case field.Type == zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok && err != nil {
+				field = zap.String(field.Key, RedactString(err.Error()))
+			}
+		}
+		redacted[i] = field
+	}
+	return redacted
+}
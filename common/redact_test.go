@@ -0,0 +1,112 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactString(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"vim-cmd hostsvc/enable_ssh", "vim-cmd hostsvc/enable_ssh"},
+		{"--password=VMware1!", "--password=********"},
+		{"--Password VMware1! --user root", "--Password ******** --user root"},
+		{`passwd="two words"`, "passwd=********"},
+		{"secret='a b' token=c", "secret=******** token=********"},
+		{"client_secret_key = abc", "client_secret_key = ********"},
+		{"esxcli system account add -i admin --password-confirmation x", "esxcli system account add -i admin --password-confirmation ********"},
+		{"https://vcenter/join?token=abc&site=1", "https://vcenter/join?token=********"},
+		{"reset ks token MAC 00:50:56:aa:bb:01", "reset ks token MAC 00:50:56:aa:bb:01"},
+		{"hashed the root password MAC 00:50:56:aa:bb:01", "hashed the root password MAC 00:50:56:aa:bb:01"},
+		{"password: the ks token is gone", "password: the ks token is gone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := RedactString(tt.s); got != tt.want {
+				t.Errorf("RedactString(%q) = %q, want %q", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSecretKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"password", true},
+		{"Password_SHA256", true},
+		{"ks_token", true},
+		{"client_secret", true},
+		{"hostname", false},
+		{"secretcli", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := IsSecretKey(tt.key); got != tt.want {
+				t.Errorf("IsSecretKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactingCore(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       string
+		field     zap.Field
+		wantMsg   string
+		wantField interface{}
+	}{
+		{
+			name:      "prose message",
+			msg:       "reset ks token MAC 00:50:56:aa:bb:01",
+			field:     zap.String("macaddress", "00:50:56:aa:bb:01"),
+			wantMsg:   "reset ks token MAC 00:50:56:aa:bb:01",
+			wantField: "00:50:56:aa:bb:01",
+		},
+		{
+			name:      "secret field",
+			msg:       "hashed the root password MAC 00:50:56:aa:bb:01",
+			field:     zap.String("password", "VMware1!"),
+			wantMsg:   "hashed the root password MAC 00:50:56:aa:bb:01",
+			wantField: RedactedValue,
+		},
+		{
+			name:      "CLI in a field",
+			msg:       "ran command",
+			field:     zap.String("command", "join --password=VMware1!"),
+			wantMsg:   "ran command",
+			wantField: "join --password=" + RedactedValue,
+		},
+		{
+			name:      "CLI in an error",
+			msg:       "command failed",
+			field:     zap.Error(errors.New("join --password VMware1! failed")),
+			wantMsg:   "command failed",
+			wantField: "join --password " + RedactedValue + " failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			zap.New(redactingCore{core}).Info(tt.msg, tt.field)
+
+			entries := logs.AllUntimed()
+			if len(entries) != 1 {
+				t.Fatalf("logged %d entries, want 1", len(entries))
+			}
+			if got := entries[0].Message; got != tt.wantMsg {
+				t.Errorf("message = %q, want %q", got, tt.wantMsg)
+			}
+			if got := entries[0].ContextMap()[tt.field.Key]; got != tt.wantField {
+				t.Errorf("field %s = %v, want %v", tt.field.Key, got, tt.wantField)
+			}
+		})
+	}
+}
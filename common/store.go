@@ -0,0 +1,465 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRegistrationNotFound = errors.New("registration not found")
+	ErrKSTokenNotFound      = errors.New("ks token not found")
+	ErrKSTokenGone          = errors.New("ks token is used up or expired")
+)
+
+// Registration holds everything the DHCP, TFTP and API servers need to know about a host.
+type Registration struct {
+	Macaddress  string    `json:"macaddress"`
+	IP          net.IP    `json:"ip,omitempty"`
+	ISOFilename string    `json:"isofilename"`
+	Hostname    string    `json:"hostname,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Lifecycle   Lifecycle `json:"lifecycle"`
+	// KS is the registration request that the ks.cfg was rendered from.
+	KS json.RawMessage `json:"ks,omitempty"`
+	// KSToken is written into the ks URL of the boot.cfg served to the host, so that the installer
+	// fetches its ks.cfg with it rather than being recognized by IP.
+	KSToken string `json:"ks_token,omitempty"`
+	// KSTokenUses counts the ks.cfg fetches made with KSToken.
+	KSTokenUses int `json:"ks_token_uses,omitempty"`
+	// KSTokenExpiresAt is when KSToken stops being accepted, or zero if it does not expire.
+	KSTokenExpiresAt time.Time `json:"ks_token_expires_at,omitempty"`
+	// CompletionToken is written into the completion URL of the ks.cfg, so that only the installed host can report completion.
+	CompletionToken string `json:"completion_token,omitempty"`
+}
+
+type storeEntry struct {
+	Op            string          `json:"op"`
+	Registration  *Registration   `json:"registration,omitempty"`
+	Registrations []*Registration `json:"registrations,omitempty"`
+	Macaddress    string          `json:"macaddress,omitempty"`
+}
+
+const (
+	storeOpPut    = "put"
+	storeOpBatch  = "batch"
+	storeOpDelete = "delete"
+)
+
+// compactThreshold is how many entries are appended to the journal, beyond one per registration, before it is compacted,
+// so that the journal of a long-running server does not keep every lease change, phase transition and ks token use.
+var compactThreshold = 1000
+
+// Store keeps host registrations in memory and journals every change to disk.
+type Store struct {
+	mu            sync.RWMutex
+	registrations map[string]*Registration
+	// quarantined are the IPs declined by a client because someone else uses them, kept out of the pool until the time they map to.
+	quarantined map[string]time.Time
+	journal     *Journal
+}
+
+func NewStore(path string) (*Store, error) {
+	journal, err := OpenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		registrations: make(map[string]*Registration),
+		quarantined:   make(map[string]time.Time),
+		journal:       journal,
+	}
+
+	err = journal.Replay(func(data json.RawMessage) error {
+		var entry storeEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to decode registration journal: %w", err)
+		}
+		switch entry.Op {
+		case storeOpPut:
+			if entry.Registration != nil {
+				s.registrations[entry.Registration.Macaddress] = entry.Registration
+			}
+		case storeOpBatch:
+			for _, reg := range entry.Registrations {
+				s.registrations[reg.Macaddress] = reg
+			}
+		case storeOpDelete:
+			delete(s.registrations, entry.Macaddress)
+		}
+		return nil
+	})
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	err = s.compact()
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Close() error {
+	return s.journal.Close()
+}
+
+// Compact rewrites the journal with the current registrations only, so that the entries they replaced are gone from disk.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+func (s *Store) compact() error {
+	entries := make([]interface{}, 0, len(s.registrations))
+	for _, reg := range s.sorted() {
+		entries = append(entries, storeEntry{Op: storeOpPut, Registration: reg})
+	}
+	return s.journal.Compact(entries)
+}
+
+func (s *Store) Get(mac string) (Registration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reg, ok := s.registrations[mac]
+	if !ok {
+		return Registration{}, false
+	}
+	return *reg, true
+}
+
+func (s *Store) List() []Registration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Registration, 0, len(s.registrations))
+	for _, reg := range s.sorted() {
+		list = append(list, *reg)
+	}
+	return list
+}
+
+// Upsert applies fn to the registration for mac, creating it if it does not exist yet.
+func (s *Store) Upsert(mac string, fn func(reg *Registration) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg := Registration{Macaddress: mac, CreatedAt: time.Now()}
+	if current, ok := s.registrations[mac]; ok {
+		reg = *current
+	}
+	return s.apply(&reg, fn)
+}
+
+// Update applies fn to an existing registration for mac.
+func (s *Store) Update(mac string, fn func(reg *Registration) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.registrations[mac]
+	if !ok {
+		return ErrRegistrationNotFound
+	}
+	reg := *current
+	return s.apply(&reg, fn)
+}
+
+// UpsertBatch applies fn to the registration of each of macs, creating the ones that do not exist yet.
+// The changes are journaled as a single entry, so either all of them are stored or none.
+func (s *Store) UpsertBatch(macs []string, fn func(i int, reg *Registration) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	regs := make([]*Registration, len(macs))
+	for i, mac := range macs {
+		reg := Registration{Macaddress: mac, CreatedAt: now}
+		if current, ok := s.registrations[mac]; ok {
+			reg = *current
+		}
+		if err := fn(i, &reg); err != nil {
+			return err
+		}
+		regs[i] = &reg
+	}
+	err := s.journal.Append(storeEntry{Op: storeOpBatch, Registrations: regs})
+	if err != nil {
+		return err
+	}
+	for _, reg := range regs {
+		s.registrations[reg.Macaddress] = reg
+	}
+	s.compactIfDue()
+	return nil
+}
+
+func (s *Store) apply(reg *Registration, fn func(reg *Registration) error) error {
+	err := fn(reg)
+	if err == errUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = s.journal.Append(storeEntry{Op: storeOpPut, Registration: reg})
+	if err != nil {
+		return err
+	}
+	s.registrations[reg.Macaddress] = reg
+	s.compactIfDue()
+	return nil
+}
+
+func (s *Store) Delete(mac string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.registrations[mac]; !ok {
+		return nil
+	}
+	err := s.journal.Append(storeEntry{Op: storeOpDelete, Macaddress: mac})
+	if err != nil {
+		return err
+	}
+	delete(s.registrations, mac)
+	s.compactIfDue()
+	return nil
+}
+
+// compactIfDue compacts the journal once compactThreshold entries have piled up in it. s.mu must be held.
+// The change that triggered it is already written, so a failure is left to the next change to retry.
+func (s *Store) compactIfDue() {
+	if s.journal.Appended() >= compactThreshold+len(s.registrations) {
+		s.compact()
+	}
+}
+
+func (s *Store) IP(mac string) (net.IP, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reg, ok := s.registrations[mac]
+	if !ok || reg.IP == nil {
+		return nil, false
+	}
+	return reg.IP, true
+}
+
+func (s *Store) ISOFilename(mac string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reg, ok := s.registrations[mac]
+	if !ok || reg.ISOFilename == "" {
+		return "", false
+	}
+	return reg.ISOFilename, true
+}
+
+// MacByIP returns the MAC address of the registration holding ip.
+func (s *Store) MacByIP(ip net.IP) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for mac, reg := range s.registrations {
+		if reg.IP != nil && reg.IP.Equal(ip) {
+			return mac, true
+		}
+	}
+	return "", false
+}
+
+// ksTokenValid tells whether the ks token of reg can still be used at now, given that it can be used maxUses times.
+// maxUses below 1 does not limit the number of uses.
+func ksTokenValid(reg *Registration, maxUses int, now time.Time) bool {
+	if maxUses > 0 && reg.KSTokenUses >= maxUses {
+		return false
+	}
+	return reg.KSTokenExpiresAt.IsZero() || now.Before(reg.KSTokenExpiresAt)
+}
+
+// NewToken returns a random token to be written into the URLs handed out to a host.
+func NewToken() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// IssueKSToken gives reg a new ks token, when the host is registered again or an operator resets its token.
+// The TTL of the token starts when the boot.cfg carrying it is first served.
+func (reg *Registration) IssueKSToken() error {
+	token, err := NewToken()
+	if err != nil {
+		return err
+	}
+	reg.KSToken = token
+	reg.KSTokenUses = 0
+	reg.KSTokenExpiresAt = time.Time{}
+	return nil
+}
+
+// IssueCompletionToken gives reg a new completion token, when the host is registered again.
+func (reg *Registration) IssueCompletionToken() error {
+	token, err := NewToken()
+	if err != nil {
+		return err
+	}
+	reg.CompletionToken = token
+	return nil
+}
+
+// CompletionToken returns the token written into the completion URL of the ks.cfg of the host registered for mac.
+// Registrations made before completion tokens existed are issued one here.
+func (s *Store) CompletionToken(mac string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.registrations[mac]
+	if !ok {
+		return "", ErrRegistrationNotFound
+	}
+	if current.CompletionToken != "" {
+		return current.CompletionToken, nil
+	}
+	reg := *current
+	err := s.apply(&reg, func(reg *Registration) error {
+		return reg.IssueCompletionToken()
+	})
+	if err != nil {
+		return "", err
+	}
+	return reg.CompletionToken, nil
+}
+
+// KSToken returns the token written into the boot.cfg served to the host registered for mac,
+// starting its TTL the first time, or never if ttl is zero.
+// A token is issued once per registration: a used up or expired token keeps being handed out, so that the installer
+// is answered 410 Gone, until the host is registered again or ResetKSToken is called.
+// Registrations made before ks tokens existed are issued one here.
+func (s *Store) KSToken(mac string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.registrations[mac]
+	if !ok {
+		return "", ErrRegistrationNotFound
+	}
+	reg := *current
+	err := s.apply(&reg, func(reg *Registration) error {
+		changed := false
+		if reg.KSToken == "" {
+			if err := reg.IssueKSToken(); err != nil {
+				return err
+			}
+			changed = true
+		}
+		if ttl > 0 && reg.KSTokenExpiresAt.IsZero() {
+			reg.KSTokenExpiresAt = time.Now().Add(ttl)
+			changed = true
+		}
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return reg.KSToken, nil
+}
+
+// ResetKSToken issues a new ks token to the host registered for mac, so that it can fetch its ks.cfg again.
+func (s *Store) ResetKSToken(mac string) error {
+	return s.Update(mac, func(reg *Registration) error {
+		return reg.IssueKSToken()
+	})
+}
+
+// UseKSToken records a ks.cfg fetch made with token and returns the MAC address of the registration holding it.
+// ErrKSTokenGone is returned if the token was already used maxUses times or is expired.
+func (s *Store) UseKSToken(token string, maxUses int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for mac, current := range s.registrations {
+		if current.KSToken == "" || subtle.ConstantTimeCompare([]byte(current.KSToken), []byte(token)) != 1 {
+			continue
+		}
+		if !ksTokenValid(current, maxUses, time.Now()) {
+			return mac, ErrKSTokenGone
+		}
+		reg := *current
+		return mac, s.apply(&reg, func(reg *Registration) error {
+			reg.KSTokenUses++
+			return nil
+		})
+	}
+	return "", ErrKSTokenNotFound
+}
+
+// quarantinedKeyPrefix keys the quarantined IPs returned by UsedIPs, which cannot be taken for a MAC address.
+const quarantinedKeyPrefix = "quarantined:"
+
+// UsedIPs returns the IP address assigned to each registered MAC address, and the quarantined IPs.
+func (s *Store) UsedIPs() map[string]net.IP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	used := make(map[string]net.IP, len(s.registrations)+len(s.quarantined))
+	for mac, reg := range s.registrations {
+		if reg.IP != nil {
+			used[mac] = reg.IP
+		}
+	}
+	for ip, until := range s.quarantined {
+		if now.Before(until) {
+			used[quarantinedKeyPrefix+ip] = net.ParseIP(ip)
+		}
+	}
+	return used
+}
+
+// QuarantineIP keeps ip out of the pool until the given time.
+func (s *Store) QuarantineIP(ip net.IP, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quarantined[ip.String()] = until
+}
+
+// UnquarantineIP puts ip back into the pool.
+func (s *Store) UnquarantineIP(ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.quarantined, ip.String())
+}
+
+// ReleaseIP removes ip from the registration holding it and returns that registration's MAC address.
+func (s *Store) ReleaseIP(ip net.IP) (string, error) {
+	mac, ok := s.MacByIP(ip)
+	if !ok {
+		return "", ErrRegistrationNotFound
+	}
+	err := s.Update(mac, func(reg *Registration) error {
+		if !reg.IP.Equal(ip) {
+			return ErrRegistrationNotFound
+		}
+		reg.IP = nil
+		return nil
+	})
+	return mac, err
+}
+
+func (s *Store) sorted() []*Registration {
+	list := make([]*Registration, 0, len(s.registrations))
+	for _, reg := range s.registrations {
+		list = append(list, reg)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].Macaddress < list[j].Macaddress
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
@@ -0,0 +1,351 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testMac1 = "00:50:56:aa:bb:01"
+	testMac2 = "00:50:56:aa:bb:02"
+)
+
+func newTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func setIP(ip string) func(reg *Registration) error {
+	return func(reg *Registration) error {
+		reg.IP = net.ParseIP(ip)
+		return nil
+	}
+}
+
+func TestStorePersistence(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     func(s *Store) error
+		wantIPs map[string]string
+	}{
+		{
+			name: "upsert creates",
+			run: func(s *Store) error {
+				return s.Upsert(testMac1, setIP("172.16.0.10"))
+			},
+			wantIPs: map[string]string{testMac1: "172.16.0.10"},
+		},
+		{
+			name: "update changes",
+			run: func(s *Store) error {
+				if err := s.Upsert(testMac1, setIP("172.16.0.10")); err != nil {
+					return err
+				}
+				return s.Update(testMac1, setIP("172.16.0.11"))
+			},
+			wantIPs: map[string]string{testMac1: "172.16.0.11"},
+		},
+		{
+			name: "delete removes",
+			run: func(s *Store) error {
+				if err := s.Upsert(testMac1, setIP("172.16.0.10")); err != nil {
+					return err
+				}
+				if err := s.Upsert(testMac2, setIP("172.16.0.11")); err != nil {
+					return err
+				}
+				return s.Delete(testMac1)
+			},
+			wantIPs: map[string]string{testMac2: "172.16.0.11"},
+		},
+		{
+			name: "failed update is not stored",
+			run: func(s *Store) error {
+				if err := s.Upsert(testMac1, setIP("172.16.0.10")); err != nil {
+					return err
+				}
+				failure := errors.New("failure")
+				err := s.Update(testMac1, func(reg *Registration) error {
+					reg.IP = net.ParseIP("172.16.0.11")
+					return failure
+				})
+				if err != failure {
+					return err
+				}
+				return nil
+			},
+			wantIPs: map[string]string{testMac1: "172.16.0.10"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "registrations.journal")
+			store, err := NewStore(path)
+			if err != nil {
+				t.Fatalf("NewStore() error = %v", err)
+			}
+			if err := tt.run(store); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			store.Close()
+
+			// Changes are replayed when the store is opened again.
+			reopened := newTestStore(t, path)
+			list := reopened.List()
+			if len(list) != len(tt.wantIPs) {
+				t.Fatalf("List() = %+v, want %d registrations", list, len(tt.wantIPs))
+			}
+			for mac, ip := range tt.wantIPs {
+				got, ok := reopened.IP(mac)
+				if !ok || !got.Equal(net.ParseIP(ip)) {
+					t.Errorf("IP(%s) = %v, %v, want %s", mac, got, ok, ip)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreUpdateNotFound(t *testing.T) {
+	store := newTestStore(t, filepath.Join(t.TempDir(), "registrations.journal"))
+	if err := store.Update(testMac1, setIP("172.16.0.10")); err != ErrRegistrationNotFound {
+		t.Errorf("Update() error = %v, want %v", err, ErrRegistrationNotFound)
+	}
+}
+
+func TestStoreUpsertBatch(t *testing.T) {
+	failure := errors.New("failure")
+	tests := []struct {
+		name    string
+		fn      func(i int, reg *Registration) error
+		wantErr error
+		wantIPs map[string]string
+	}{
+		{
+			name: "stores every registration",
+			fn: func(i int, reg *Registration) error {
+				reg.Hostname = reg.Macaddress
+				return nil
+			},
+			wantIPs: map[string]string{testMac1: "172.16.0.10", testMac2: ""},
+		},
+		{
+			name: "stores nothing when one fails",
+			fn: func(i int, reg *Registration) error {
+				reg.Hostname = reg.Macaddress
+				if i == 1 {
+					return failure
+				}
+				return nil
+			},
+			wantErr: failure,
+			wantIPs: map[string]string{testMac1: "172.16.0.10"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "registrations.journal")
+			store, err := NewStore(path)
+			if err != nil {
+				t.Fatalf("NewStore() error = %v", err)
+			}
+			if err := store.Upsert(testMac1, setIP("172.16.0.10")); err != nil {
+				t.Fatalf("Upsert() error = %v", err)
+			}
+			if err := store.UpsertBatch([]string{testMac1, testMac2}, tt.fn); err != tt.wantErr {
+				t.Fatalf("UpsertBatch() error = %v, want %v", err, tt.wantErr)
+			}
+			store.Close()
+
+			reopened := newTestStore(t, path)
+			list := reopened.List()
+			if len(list) != len(tt.wantIPs) {
+				t.Fatalf("List() = %+v, want %d registrations", list, len(tt.wantIPs))
+			}
+			for _, reg := range list {
+				ip, ok := tt.wantIPs[reg.Macaddress]
+				if !ok {
+					t.Errorf("unexpected registration of %s", reg.Macaddress)
+					continue
+				}
+				// The existing registration keeps what fn does not change.
+				if (ip == "" && reg.IP != nil) || (ip != "" && !reg.IP.Equal(net.ParseIP(ip))) {
+					t.Errorf("IP of %s = %v, want %q", reg.Macaddress, reg.IP, ip)
+				}
+				wantHostname := reg.Macaddress
+				if tt.wantErr != nil {
+					wantHostname = ""
+				}
+				if reg.Hostname != wantHostname {
+					t.Errorf("hostname of %s = %q, want %q", reg.Macaddress, reg.Hostname, wantHostname)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreKSToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		maxUses  int
+		uses     int
+		expire   bool
+		reset    bool
+		wantUsed []error
+	}{
+		{name: "single use", maxUses: 1, wantUsed: []error{nil, ErrKSTokenGone}},
+		{name: "several uses", maxUses: 3, wantUsed: []error{nil, nil, nil, ErrKSTokenGone}},
+		{name: "unlimited uses", maxUses: 0, wantUsed: []error{nil, nil, nil, nil}},
+		{name: "within the TTL", ttl: time.Hour, maxUses: 0, wantUsed: []error{nil}},
+		{name: "expired", ttl: time.Hour, maxUses: 0, expire: true, wantUsed: []error{ErrKSTokenGone}},
+		{name: "reset after use", maxUses: 1, uses: 1, reset: true, wantUsed: []error{nil, ErrKSTokenGone}},
+		{name: "reset after expiry", ttl: time.Hour, maxUses: 0, expire: true, reset: true, wantUsed: []error{nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t, filepath.Join(t.TempDir(), "registrations.journal"))
+			if err := store.Upsert(testMac1, func(reg *Registration) error { return reg.IssueKSToken() }); err != nil {
+				t.Fatalf("Upsert() error = %v", err)
+			}
+			token, err := store.KSToken(testMac1, tt.ttl)
+			if err != nil {
+				t.Fatalf("KSToken() error = %v", err)
+			}
+			for i := 0; i < tt.uses; i++ {
+				if _, err := store.UseKSToken(token, tt.maxUses); err != nil {
+					t.Fatalf("UseKSToken() error = %v", err)
+				}
+			}
+			if tt.expire {
+				err := store.Update(testMac1, func(reg *Registration) error {
+					reg.KSTokenExpiresAt = time.Now().Add(-time.Second)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.reset {
+				if err := store.ResetKSToken(testMac1); err != nil {
+					t.Fatalf("ResetKSToken() error = %v", err)
+				}
+				consumed := token
+				if token, err = store.KSToken(testMac1, tt.ttl); err != nil {
+					t.Fatalf("KSToken() error = %v", err)
+				}
+				if token == consumed {
+					t.Fatalf("ResetKSToken() kept token %s", token)
+				}
+				if _, err := store.UseKSToken(consumed, tt.maxUses); err != ErrKSTokenNotFound {
+					t.Errorf("UseKSToken() of the replaced token error = %v, want %v", err, ErrKSTokenNotFound)
+				}
+			}
+
+			for i, want := range tt.wantUsed {
+				mac, err := store.UseKSToken(token, tt.maxUses)
+				if err != want {
+					t.Errorf("use %d: UseKSToken() error = %v, want %v", i+1, err, want)
+				}
+				if mac != testMac1 {
+					t.Errorf("use %d: UseKSToken() = %s, want %s", i+1, mac, testMac1)
+				}
+			}
+			// A used up or expired token keeps being handed out, so that the installer is answered 410 Gone.
+			if again, err := store.KSToken(testMac1, tt.ttl); err != nil || again != token {
+				t.Errorf("KSToken() = %s, %v, want the same token %s", again, err, token)
+			}
+		})
+	}
+}
+
+func TestStoreKSTokenTTLStartsOnce(t *testing.T) {
+	store := newTestStore(t, filepath.Join(t.TempDir(), "registrations.journal"))
+	if err := store.Upsert(testMac1, func(reg *Registration) error { return nil }); err != nil {
+		t.Fatalf("Upsert() error = %v", err)
+	}
+	// Registrations made before ks tokens existed are issued one.
+	token, err := store.KSToken(testMac1, time.Hour)
+	if err != nil || token == "" {
+		t.Fatalf("KSToken() = %q, %v, want a token", token, err)
+	}
+	reg, _ := store.Get(testMac1)
+	expiresAt := reg.KSTokenExpiresAt
+	if expiresAt.IsZero() {
+		t.Fatalf("KSToken() did not start the TTL")
+	}
+	if _, err := store.KSToken(testMac1, 2*time.Hour); err != nil {
+		t.Fatalf("KSToken() error = %v", err)
+	}
+	reg, _ = store.Get(testMac1)
+	if !reg.KSTokenExpiresAt.Equal(expiresAt) {
+		t.Errorf("KSToken() moved the expiry from %s to %s", expiresAt, reg.KSTokenExpiresAt)
+	}
+	if _, err := store.UseKSToken("0123456789abcdef", 0); err != ErrKSTokenNotFound {
+		t.Errorf("UseKSToken() of an unknown token error = %v, want %v", err, ErrKSTokenNotFound)
+	}
+}
+
+func TestStoreCompactsJournal(t *testing.T) {
+	defer func(threshold int) { compactThreshold = threshold }(compactThreshold)
+	compactThreshold = 10
+
+	path := filepath.Join(t.TempDir(), "registrations.journal")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	for _, mac := range []string{testMac1, testMac2} {
+		if err := store.Upsert(mac, setIP("172.16.0.10")); err != nil {
+			t.Fatalf("Upsert() error = %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := store.UseKSToken(mustKSToken(t, store, testMac1), 0); err != nil {
+			t.Fatalf("UseKSToken() error = %v", err)
+		}
+		if i%10 == 0 {
+			if err := store.Update(testMac2, setIP(fmt.Sprintf("172.16.0.%d", 11+i/10))); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// One entry per registration after a compaction, and as many again plus the threshold before the next one.
+		if lines, max := bytes.Count(data, []byte{'\n'}), compactThreshold+2*2; lines > max {
+			t.Fatalf("journal holds %d entries after %d changes, want at most %d", lines, i+1, max)
+		}
+	}
+	store.Close()
+
+	reopened := newTestStore(t, path)
+	reg, _ := reopened.Get(testMac1)
+	if reg.KSTokenUses != 100 {
+		t.Errorf("ks token uses = %d, want 100", reg.KSTokenUses)
+	}
+	if ip, _ := reopened.IP(testMac2); !ip.Equal(net.ParseIP("172.16.0.20")) {
+		t.Errorf("IP(%s) = %v, want 172.16.0.20", testMac2, ip)
+	}
+}
+
+func mustKSToken(t *testing.T, store *Store, mac string) string {
+	t.Helper()
+	token, err := store.KSToken(mac, 0)
+	if err != nil {
+		t.Fatalf("KSToken() error = %v", err)
+	}
+	return token
+}
@@ -2,22 +2,43 @@ package config
 
 import (
 	"net"
+	"time"
 )
 
 type Config struct {
-	APIPortAddr     net.IP     `split_words:"true"`
-	APIPortMask     net.IPMask `split_words:"true"`
-	APIServerPort   int        `default:"80" split_words:"true"`
-	ServicePortName string     `split_words:"true"`
-	ServicePortAddr net.IP     `split_words:"true"`
-	ServicePortMask net.IPMask `split_words:"true"`
-	ServiceIpAddr   string     `split_words:"true"`
-	APIIpAddr       string     `split_words:"true"`
-	DHCPStartIP     string     `split_words:"true"`
-	DHCPEndIP       string     `split_words:"true"`
-	KsDirPath       string     `default:"./" split_words:"true"`
-	FileDirPath     string     `default:"./files" split_words:"true"`
-	LogFilePath     string     `default:"/var/log/ks-server.log" split_words:"true"`
+	APIPortAddr           net.IP        `split_words:"true"`
+	APIPortMask           net.IPMask    `split_words:"true"`
+	APIServerPort         int           `default:"80" split_words:"true"`
+	BootServerPort        int           `default:"80" split_words:"true"`
+	ServicePortName       string        `split_words:"true"`
+	ServicePortAddr       net.IP        `split_words:"true"`
+	ServicePortMask       net.IPMask    `split_words:"true"`
+	ServiceIpAddr         string        `split_words:"true"`
+	APIIpAddr             string        `split_words:"true"`
+	DHCPStartIP           string        `split_words:"true"`
+	DHCPEndIP             string        `split_words:"true"`
+	DHCPLeaseTime         time.Duration `default:"2h" split_words:"true"`
+	DHCPRenewalTime       time.Duration `split_words:"true"`
+	DHCPRebindingTime     time.Duration `split_words:"true"`
+	KsDirPath             string        `default:"./" split_words:"true"`
+	FileDirPath           string        `default:"./files" split_words:"true"`
+	LogFilePath           string        `default:"/var/log/ks-server.log" split_words:"true"`
+	CallbackServerAddr    string        `split_words:"true"`
+	AutoCleanupOnComplete bool          `default:"false" split_words:"true"`
+	WebhookConfigPath     string        `split_words:"true"`
+	AuthConfigPath        string        `split_words:"true"`
+	TLSEnabled            bool          `default:"false" split_words:"true"`
+	TLSCertPath           string        `split_words:"true"`
+	TLSKeyPath            string        `split_words:"true"`
+	MaxRequestBodySize    int64         `default:"1048576" split_words:"true"`
+	MaxBulkBodySize       int64         `default:"10485760" split_words:"true"`
+	MaxUploadSize         int64         `default:"8589934592" split_words:"true"`
+	MaxConcurrentUploads  int           `default:"2" split_words:"true"`
+	RateLimit             float64       `default:"10" split_words:"true"`
+	RateLimitBurst        int           `default:"20" split_words:"true"`
+	KSTokenMaxUses        int           `default:"1" split_words:"true"`
+	KSTokenTTL            time.Duration `default:"1h" split_words:"true"`
+	KSFallbackToIP        bool          `default:"false" split_words:"true"`
 }
 
 type PortInfo struct {
@@ -28,30 +49,77 @@ type PortInfo struct {
 
 func LoadDefaultConfig(apiPort, servicePort *PortInfo, cfg *Config) *Config {
 	return &Config{
-		APIPortAddr:     apiPort.IPAddress,
-		APIPortMask:     apiPort.SubnetMask,
-		APIServerPort:   cfg.APIServerPort,
-		ServicePortName: servicePort.InterfaceName,
-		ServicePortAddr: servicePort.IPAddress,
-		ServicePortMask: servicePort.SubnetMask,
-		KsDirPath:       cfg.KsDirPath,
-		FileDirPath:     cfg.FileDirPath,
-		LogFilePath:     cfg.LogFilePath,
+		APIPortAddr:           apiPort.IPAddress,
+		APIPortMask:           apiPort.SubnetMask,
+		APIServerPort:         cfg.APIServerPort,
+		BootServerPort:        cfg.BootServerPort,
+		ServicePortName:       servicePort.InterfaceName,
+		ServicePortAddr:       servicePort.IPAddress,
+		ServicePortMask:       servicePort.SubnetMask,
+		DHCPStartIP:           cfg.DHCPStartIP,
+		DHCPEndIP:             cfg.DHCPEndIP,
+		DHCPLeaseTime:         cfg.DHCPLeaseTime,
+		DHCPRenewalTime:       cfg.DHCPRenewalTime,
+		DHCPRebindingTime:     cfg.DHCPRebindingTime,
+		KsDirPath:             cfg.KsDirPath,
+		FileDirPath:           cfg.FileDirPath,
+		LogFilePath:           cfg.LogFilePath,
+		CallbackServerAddr:    cfg.CallbackServerAddr,
+		AutoCleanupOnComplete: cfg.AutoCleanupOnComplete,
+		WebhookConfigPath:     cfg.WebhookConfigPath,
+		AuthConfigPath:        cfg.AuthConfigPath,
+		TLSEnabled:            cfg.TLSEnabled,
+		TLSCertPath:           cfg.TLSCertPath,
+		TLSKeyPath:            cfg.TLSKeyPath,
+		MaxRequestBodySize:    cfg.MaxRequestBodySize,
+		MaxBulkBodySize:       cfg.MaxBulkBodySize,
+		MaxUploadSize:         cfg.MaxUploadSize,
+		MaxConcurrentUploads:  cfg.MaxConcurrentUploads,
+		RateLimit:             cfg.RateLimit,
+		RateLimitBurst:        cfg.RateLimitBurst,
+		KSTokenMaxUses:        cfg.KSTokenMaxUses,
+		KSTokenTTL:            cfg.KSTokenTTL,
+		KSFallbackToIP:        cfg.KSFallbackToIP,
 	}
 }
 
+// InstallerScheme returns the URL scheme that installing hosts use to reach the API server.
+func InstallerScheme(cfg *Config) string {
+	if cfg.TLSEnabled {
+		return "https"
+	}
+	return "http"
+}
+
 type DHCPLeaseConfig struct {
 	DHCPInterfaceName string
 	DHCPStartIP       net.IP
 	DHCPEndIP         net.IP
+	LeaseTime         time.Duration
+	RenewalTime       time.Duration
+	RebindingTime     time.Duration
 }
 
 func LoadDHCPLeaseConfig(config *Config, startIP, endIP net.IP) *DHCPLeaseConfig {
-	return &DHCPLeaseConfig{
+	leaseCfg := &DHCPLeaseConfig{
 		DHCPInterfaceName: config.ServicePortName,
 		DHCPStartIP:       startIP,
 		DHCPEndIP:         endIP,
+		LeaseTime:         config.DHCPLeaseTime,
+		RenewalTime:       config.DHCPRenewalTime,
+		RebindingTime:     config.DHCPRebindingTime,
+	}
+	// T1 and T2 default to 50% and 87.5% of the lease time as recommended by RFC 2131.
+	if leaseCfg.RenewalTime <= 0 || leaseCfg.RenewalTime > leaseCfg.LeaseTime {
+		leaseCfg.RenewalTime = leaseCfg.LeaseTime / 2
+	}
+	if leaseCfg.RebindingTime <= 0 || leaseCfg.RebindingTime > leaseCfg.LeaseTime {
+		leaseCfg.RebindingTime = leaseCfg.LeaseTime * 7 / 8
 	}
+	if leaseCfg.RebindingTime < leaseCfg.RenewalTime {
+		leaseCfg.RebindingTime = leaseCfg.RenewalTime
+	}
+	return leaseCfg
 }
 
 type FileRootDirInfo struct {
@@ -65,3 +133,44 @@ func LoadDirInfo(bootFileDir, uploadedISODir string) *FileRootDirInfo {
 		UploadedISODirPath: uploadedISODir,
 	}
 }
+
+// WebhookConfig is a subscription that receives the events given in Events, or every event if it is empty.
+// MaxRetries is nil when max_retries is not set, and 0 when failed deliveries must not be retried.
+type WebhookConfig struct {
+	URL        string   `yaml:"url"`
+	Events     []string `yaml:"events"`
+	Secret     string   `yaml:"secret"`
+	MaxRetries *int     `yaml:"max_retries"`
+}
+
+type WebhooksConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+}
+
+// Roles granted to API users, each allowing what the previous one does.
+const (
+	RoleReadOnly = "read-only"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// UserConfig is a user of the management API authenticating with basic auth.
+// The password is given either in clear text or as its hex encoded SHA-256 hash.
+type UserConfig struct {
+	Username       string `yaml:"username"`
+	Password       string `yaml:"password"`
+	PasswordSHA256 string `yaml:"password_sha256"`
+	Role           string `yaml:"role"`
+}
+
+// TokenConfig is a bearer token for the management API.
+type TokenConfig struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+type AuthConfig struct {
+	Users  []UserConfig  `yaml:"users"`
+	Tokens []TokenConfig `yaml:"tokens"`
+}
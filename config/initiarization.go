@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"os"
 	"strings"
 
 	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v2"
 )
 
 func LoadServerConfig() (*Config, error) {
@@ -52,6 +55,9 @@ func LoadServerConfig() (*Config, error) {
 		}
 	}
 	config := LoadDefaultConfig(apiPort, servicePort, &cfg)
+	if config.APIPortAddr.Equal(config.ServicePortAddr) && config.APIServerPort == config.BootServerPort {
+		return nil, fmt.Errorf("error: API_SERVER_PORT and BOOT_SERVER_PORT must differ when the API and service ports share the IP %s", config.APIPortAddr)
+	}
 	return config, nil
 }
 
@@ -190,3 +196,68 @@ func GetDHCPLeaseConfig(cfg *Config) *DHCPLeaseConfig {
 	}
 	return LoadDHCPLeaseConfig(cfg, startIP, endIP)
 }
+
+const defaultWebhookMaxRetries = 5
+
+func LoadWebhookConfig(path string) ([]WebhookConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open webhook config: %w", err)
+	}
+	defer file.Close()
+
+	var cfg WebhooksConfig
+	if err := yaml.NewDecoder(file).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("could not decode webhook config: %w", err)
+	}
+	for i, webhook := range cfg.Webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook url %q", webhook.URL)
+		}
+		if webhook.MaxRetries == nil {
+			maxRetries := defaultWebhookMaxRetries
+			cfg.Webhooks[i].MaxRetries = &maxRetries
+		} else if *webhook.MaxRetries < 0 {
+			return nil, fmt.Errorf("max_retries of webhook %s must not be negative", webhook.URL)
+		}
+	}
+	return cfg.Webhooks, nil
+}
+
+func validRole(role string) bool {
+	return role == RoleReadOnly || role == RoleOperator || role == RoleAdmin
+}
+
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open auth config: %w", err)
+	}
+	defer file.Close()
+
+	var cfg AuthConfig
+	if err := yaml.NewDecoder(file).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("could not decode auth config: %w", err)
+	}
+	for _, user := range cfg.Users {
+		if user.Username == "" {
+			return nil, errors.New("user without username in auth config")
+		}
+		if (user.Password == "") == (user.PasswordSHA256 == "") {
+			return nil, fmt.Errorf("user %s must have either password or password_sha256", user.Username)
+		}
+		if !validRole(user.Role) {
+			return nil, fmt.Errorf("invalid role %q of user %s", user.Role, user.Username)
+		}
+	}
+	for _, token := range cfg.Tokens {
+		if token.Name == "" || token.Token == "" {
+			return nil, errors.New("token without name or token in auth config")
+		}
+		if !validRole(token.Role) {
+			return nil, fmt.Errorf("invalid role %q of token %s", token.Role, token.Name)
+		}
+	}
+	return &cfg, nil
+}
@@ -6,14 +6,26 @@ import (
 	"fmt"
 	"kickstart/common"
 	"kickstart/config"
-	"net/url"
+	"net"
 	"path/filepath"
 	"strconv"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 	"go.universe.tf/netboot/dhcp4"
 )
 
+const (
+	optRenewalTime   dhcp4.Option = 58
+	optRebindingTime dhcp4.Option = 59
+)
+
+var dhcpPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ks_dhcp_packets_total",
+	Help: "DHCP packets received by message type and outcome.",
+}, []string{"type", "outcome"})
+
 func intToHexBytes(n int) []byte {
 	hexString := fmt.Sprintf("%08x", n)
 	byteArray := make([]byte, 0, len(hexString)/2)
@@ -26,9 +38,10 @@ func intToHexBytes(n int) []byte {
 	return byteArray
 }
 
-func RunServer(ctx context.Context, config *config.Config, logger *zap.Logger) {
-	serverIP := config.ServicePortAddr
-	serverNetMask := config.ServicePortMask
+func RunServer(ctx context.Context, cfg *config.Config, logger *zap.Logger, store *common.Store, events *common.EventBus) {
+	serverIP := cfg.ServicePortAddr
+	serverNetMask := cfg.ServicePortMask
+	leaseCfg := config.GetDHCPLeaseConfig(cfg)
 	listen := fmt.Sprintf("%s:67", serverIP)
 	conn, err := dhcp4.NewConn(listen)
 	if err != nil {
@@ -43,29 +56,46 @@ func RunServer(ctx context.Context, config *config.Config, logger *zap.Logger) {
 
 	defer conn.Close()
 
+	leases, err := NewLeaseTable(filepath.Join(cfg.FileDirPath, "leases.journal"), store, logger)
+	if err != nil {
+		logger.Fatal("unable to load DHCP leases", zap.Error(err))
+	}
+	defer leases.Close()
+	go leases.RunReaper(ctx)
+
 	logger.Info("starting DHCP server...")
 	for {
 		req, intf, err := conn.RecvDHCP()
 		if err != nil {
 			logger.Error("failed to receive DHCP package", zap.Error(err))
+			continue
 		}
 
 		logger.Info(fmt.Sprintf("received %s from %s", req.Type, req.HardwareAddr))
 
-		common.MacIPMapMutex.RLock()
-		ip, found := common.MacIPMap[req.HardwareAddr.String()]
-		common.MacIPMapMutex.RUnlock()
-
+		mac := req.HardwareAddr.String()
+		ip, found := store.IP(mac)
 		if !found {
-			logger.Warn(fmt.Sprintf("no IP address found for MAC address: %s", req.HardwareAddr))
-			continue
+			// The IP of a registered host may have been reclaimed after its lease expired.
+			_, registered := store.Get(mac)
+			if !registered || req.Type != dhcp4.MsgDiscover {
+				logger.Warn(fmt.Sprintf("no IP address found for MAC address: %s", req.HardwareAddr))
+				dhcpPackets.WithLabelValues(req.Type.String(), "no_ip_for_mac").Inc()
+				continue
+			}
+			ip, _, err = store.AssignIP(mac, leaseCfg)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to assign IP address to MAC address: %s", req.HardwareAddr), zap.Error(err))
+				dhcpPackets.WithLabelValues(req.Type.String(), "pool_exhausted").Inc()
+				continue
+			}
+			logger.Info(fmt.Sprintf("assigned IP %s to MAC %s", ip, mac))
 		}
 
-		common.MacFileMapMutex.RLock()
-		bootFilename, found := common.MacFileMap[req.HardwareAddr.String()]
-		common.MacFileMapMutex.RUnlock()
+		bootFilename, found := store.ISOFilename(mac)
 		if !found {
 			logger.Warn(fmt.Sprintf("no ISO file found for MAC address: %s", req.HardwareAddr))
+			dhcpPackets.WithLabelValues(req.Type.String(), "no_iso_for_mac").Inc()
 			continue
 		}
 
@@ -81,31 +111,16 @@ func RunServer(ctx context.Context, config *config.Config, logger *zap.Logger) {
 		clientArch := req.Options[93]
 		userClass := req.Options[77]
 		if clientArch != nil {
-			switch binary.BigEndian.Uint16(clientArch) {
-			case 0: //bios
-				if userClass != nil && string(userClass) == "iPXE" {
-					bootFilename = filepath.Join(bootFilename, "pxelinux.0")
-				} else {
-					bootFilename = filepath.Join(bootFilename, "undionly.kpxe")
-				}
-			case 6, 7, 9: //uefi
-				if userClass != nil && string(userClass) == "iPXE" {
-					bootFilename = filepath.Join(bootFilename, "mboot.efi")
-				} else {
-					bootFilename = filepath.Join(bootFilename, "ipxe.efi")
-				}
-			case 16: //uefi http
-				url := &url.URL{
-					Scheme: "http",
-					Host:   serverIP.String(),
-					Path:   filepath.Join("installer", bootFilename, "mboot.efi"),
-				}
-				bootFilename = url.String()
-				resp.Options[dhcp4.OptVendorIdentifier] = []byte("HTTPClient")
-			default:
+			arch := binary.BigEndian.Uint16(clientArch)
+			bootFilename, found = common.BootFilename(cfg, bootFilename, arch, userClass != nil && string(userClass) == "iPXE")
+			if !found {
 				logger.Info(fmt.Sprintf("unknown client system architecture for MAC address: %s", req.HardwareAddr))
+				dhcpPackets.WithLabelValues(req.Type.String(), "unknown_arch").Inc()
 				continue
 			}
+			if arch == common.ArchUEFIHTTP {
+				resp.Options[dhcp4.OptVendorIdentifier] = []byte("HTTPClient")
+			}
 			resp.BootFilename = bootFilename
 		} else {
 			logger.Info(fmt.Sprintf("no client system architecture found for MAC address: %s", req.HardwareAddr))
@@ -113,31 +128,73 @@ func RunServer(ctx context.Context, config *config.Config, logger *zap.Logger) {
 
 		resp.Options[dhcp4.OptServerIdentifier] = serverIP
 		resp.Options[dhcp4.OptSubnetMask] = serverNetMask
-		resp.Options[dhcp4.OptLeaseTime] = intToHexBytes(7200)
+		resp.Options[dhcp4.OptLeaseTime] = intToHexBytes(int(leaseCfg.LeaseTime.Seconds()))
+		resp.Options[optRenewalTime] = intToHexBytes(int(leaseCfg.RenewalTime.Seconds()))
+		resp.Options[optRebindingTime] = intToHexBytes(int(leaseCfg.RebindingTime.Seconds()))
 
 		switch req.Type {
 		case dhcp4.MsgDiscover:
 			resp.Broadcast = true
 			resp.Type = dhcp4.MsgOffer
+			err = leases.Offer(mac, ip)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to record offered lease of IP %s", ip), zap.Error(err))
+			}
 
 		case dhcp4.MsgRequest:
+			serverID := req.Options[dhcp4.OptServerIdentifier]
+			if serverID != nil && !net.IP(serverID).Equal(serverIP) {
+				logger.Info(fmt.Sprintf("MAC %s selected another DHCP server %s", mac, net.IP(serverID)))
+				err = leases.Release(mac)
+				if err != nil {
+					logger.Error(fmt.Sprintf("failed to drop offered lease of IP %s", ip), zap.Error(err))
+				}
+				dhcpPackets.WithLabelValues(req.Type.String(), "other_server").Inc()
+				continue
+			}
 			resp.Type = dhcp4.MsgAck
+			err = leases.Bind(mac, ip, leaseCfg.LeaseTime)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to record bound lease of IP %s", ip), zap.Error(err))
+			}
 
 		case dhcp4.MsgRelease:
-			deleteIP := req.ClientAddr
-			for k, v := range common.MacIPMap {
-				if v.Equal(deleteIP) {
-					common.MacIPMapMutex.Lock()
-					delete(common.MacIPMap, k)
-					common.MacIPMapMutex.Unlock()
-					logger.Info(fmt.Sprintf("IP %s has been released and removed from macIPMap", deleteIP.String()))
-					break
-				}
+			err = leases.Release(mac)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to drop lease of IP %s", req.ClientAddr), zap.Error(err))
+			}
+			_, err := store.ReleaseIP(req.ClientAddr)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to release IP %s", req.ClientAddr), zap.Error(err))
+				dhcpPackets.WithLabelValues(req.Type.String(), "error").Inc()
+				continue
 			}
+			logger.Info(fmt.Sprintf("IP %s has been released and removed from registration", req.ClientAddr.String()))
+			dhcpPackets.WithLabelValues(req.Type.String(), "released").Inc()
+			continue
+
+		case dhcp4.MsgDecline:
+			// A declined IP is in use by someone else: it is quarantined for the lease time, so that it is not handed out
+			// again while the other user may still hold it, and the next discover gets another one.
+			err = leases.Decline(mac, ip, leaseCfg.LeaseTime)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to quarantine IP %s", ip), zap.Error(err))
+				dhcpPackets.WithLabelValues(req.Type.String(), "error").Inc()
+				continue
+			}
+			_, err := store.ReleaseIP(ip)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to release IP %s", ip), zap.Error(err))
+				dhcpPackets.WithLabelValues(req.Type.String(), "error").Inc()
+				continue
+			}
+			logger.Info(fmt.Sprintf("IP %s declined by MAC %s has been quarantined for %s", ip, mac, leaseCfg.LeaseTime))
+			dhcpPackets.WithLabelValues(req.Type.String(), "declined").Inc()
 			continue
 
 		default:
 			logger.Warn(fmt.Sprintf("message type %s not supported", req.Type))
+			dhcpPackets.WithLabelValues(req.Type.String(), "unsupported").Inc()
 			continue
 		}
 
@@ -145,6 +202,23 @@ func RunServer(ctx context.Context, config *config.Config, logger *zap.Logger) {
 		err = conn.SendDHCP(resp, intf)
 		if err != nil {
 			logger.Error("unable to send DHCP packet", zap.Error(err))
+			dhcpPackets.WithLabelValues(req.Type.String(), "error").Inc()
+			continue
+		}
+		dhcpPackets.WithLabelValues(req.Type.String(), "replied").Inc()
+
+		phase := common.PhaseOffered
+		eventType := common.EventDHCPOffer
+		if resp.Type == dhcp4.MsgAck {
+			phase = common.PhaseAcked
+			eventType = common.EventDHCPAck
+		}
+		events.Publish(common.Event{Type: eventType, Macaddress: mac, IP: ip.String(), File: resp.BootFilename})
+		moved, err := store.Transition(mac, phase)
+		if err != nil {
+			logger.Error("failed to update installation status", zap.Error(err))
+		} else if moved {
+			logger.Info(fmt.Sprintf("installation of MAC %s moved to %s phase", mac, phase))
 		}
 	}
 }
@@ -0,0 +1,306 @@
+package dhcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kickstart/common"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type LeaseState string
+
+const (
+	LeaseOffered LeaseState = "offered"
+	LeaseBound   LeaseState = "bound"
+	LeaseExpired LeaseState = "expired"
+	// LeaseDeclined is an IP that a client found in use by someone else, quarantined until it expires.
+	LeaseDeclined LeaseState = "declined"
+)
+
+// offerHoldTime is how long an offered IP is held for a client that has not requested it yet.
+const offerHoldTime = time.Minute
+
+const reapInterval = 30 * time.Second
+
+// compactThreshold is how many entries are appended to the lease journal, beyond one per lease, before Reap compacts it.
+var compactThreshold = 1000
+
+type Lease struct {
+	Macaddress string     `json:"macaddress"`
+	IP         net.IP     `json:"ip"`
+	State      LeaseState `json:"state"`
+	GrantedAt  time.Time  `json:"granted_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
+
+type leaseEntry struct {
+	Op         string `json:"op"`
+	Lease      *Lease `json:"lease,omitempty"`
+	Macaddress string `json:"macaddress,omitempty"`
+	IP         net.IP `json:"ip,omitempty"`
+}
+
+// LeaseTable records the leases handed out by the DHCP server and reclaims the expired ones.
+type LeaseTable struct {
+	mu     sync.Mutex
+	leases map[string]*Lease
+	// declined are the quarantined IPs by IP address.
+	declined map[string]*Lease
+	journal  *common.Journal
+	store    *common.Store
+	logger   *zap.Logger
+}
+
+func NewLeaseTable(path string, store *common.Store, logger *zap.Logger) (*LeaseTable, error) {
+	journal, err := common.OpenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &LeaseTable{
+		leases:   make(map[string]*Lease),
+		declined: make(map[string]*Lease),
+		journal:  journal,
+		store:    store,
+		logger:   logger,
+	}
+
+	err = journal.Replay(func(data json.RawMessage) error {
+		var entry leaseEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to decode lease journal: %w", err)
+		}
+		switch entry.Op {
+		case "put":
+			if entry.Lease != nil {
+				t.leases[entry.Lease.Macaddress] = entry.Lease
+			}
+		case "delete":
+			delete(t.leases, entry.Macaddress)
+		case "decline":
+			if entry.Lease != nil {
+				t.declined[entry.Lease.IP.String()] = entry.Lease
+			}
+		case "undecline":
+			delete(t.declined, entry.IP.String())
+		}
+		return nil
+	})
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	for _, lease := range t.declined {
+		store.QuarantineIP(lease.IP, lease.ExpiresAt)
+	}
+	err = t.compact()
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *LeaseTable) Close() error {
+	return t.journal.Close()
+}
+
+// Offer holds ip for mac while the client decides whether to request it.
+// A bound lease for the same IP is left untouched so that a rebooting client does not lose it.
+func (t *LeaseTable) Offer(mac string, ip net.IP) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if current, ok := t.leases[mac]; ok && current.State == LeaseBound && current.IP.Equal(ip) && now.Before(current.ExpiresAt) {
+		return nil
+	}
+	return t.put(&Lease{
+		Macaddress: mac,
+		IP:         ip,
+		State:      LeaseOffered,
+		GrantedAt:  now,
+		ExpiresAt:  now.Add(offerHoldTime),
+	})
+}
+
+// Bind grants or renews the lease of ip to mac for leaseTime.
+func (t *LeaseTable) Bind(mac string, ip net.IP, leaseTime time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	return t.put(&Lease{
+		Macaddress: mac,
+		IP:         ip,
+		State:      LeaseBound,
+		GrantedAt:  now,
+		ExpiresAt:  now.Add(leaseTime),
+	})
+}
+
+// Release forgets the lease of mac.
+func (t *LeaseTable) Release(mac string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.leases[mac]; !ok {
+		return nil
+	}
+	err := t.journal.Append(leaseEntry{Op: "delete", Macaddress: mac})
+	if err != nil {
+		return err
+	}
+	delete(t.leases, mac)
+	return nil
+}
+
+// Decline forgets the lease of mac and quarantines ip for quarantineTime, because mac found it in use by someone else.
+// The IP is kept out of the pool until then, as RFC 2131 section 3.1.5 asks.
+func (t *LeaseTable) Decline(mac string, ip net.IP, quarantineTime time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.leases[mac]; ok {
+		err := t.journal.Append(leaseEntry{Op: "delete", Macaddress: mac})
+		if err != nil {
+			return err
+		}
+		delete(t.leases, mac)
+	}
+	now := time.Now()
+	lease := &Lease{
+		Macaddress: mac,
+		IP:         ip,
+		State:      LeaseDeclined,
+		GrantedAt:  now,
+		ExpiresAt:  now.Add(quarantineTime),
+	}
+	err := t.journal.Append(leaseEntry{Op: "decline", Lease: lease})
+	if err != nil {
+		return err
+	}
+	t.declined[ip.String()] = lease
+	t.store.QuarantineIP(ip, lease.ExpiresAt)
+	return nil
+}
+
+func (t *LeaseTable) List() []Lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]Lease, 0, len(t.leases))
+	for _, lease := range t.leases {
+		list = append(list, *lease)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Macaddress < list[j].Macaddress
+	})
+	return list
+}
+
+// Reap marks the leases that ran out as expired and frees their IPs back into the pool.
+// Expired leases of hosts that are no longer registered are dropped from the table,
+// and declined IPs whose quarantine is over are put back into the pool.
+// The journal is compacted once compactThreshold entries have been appended to it.
+func (t *LeaseTable) Reap(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, lease := range t.declined {
+		if now.Before(lease.ExpiresAt) {
+			continue
+		}
+		err := t.journal.Append(leaseEntry{Op: "undecline", IP: lease.IP})
+		if err != nil {
+			t.logger.Error(fmt.Sprintf("failed to end quarantine of IP %s", lease.IP), zap.Error(err))
+			continue
+		}
+		delete(t.declined, key)
+		t.store.UnquarantineIP(lease.IP)
+		t.logger.Info(fmt.Sprintf("quarantine of IP %s declined by MAC %s is over", lease.IP, lease.Macaddress))
+	}
+	for mac, lease := range t.leases {
+		_, registered := t.store.Get(mac)
+		if lease.State == LeaseExpired {
+			if !registered {
+				err := t.journal.Append(leaseEntry{Op: "delete", Macaddress: mac})
+				if err != nil {
+					t.logger.Error("failed to drop expired lease", zap.Error(err))
+					continue
+				}
+				delete(t.leases, mac)
+			}
+			continue
+		}
+		if now.Before(lease.ExpiresAt) {
+			continue
+		}
+
+		expired := *lease
+		expired.State = LeaseExpired
+		err := t.put(&expired)
+		if err != nil {
+			t.logger.Error(fmt.Sprintf("failed to expire lease of MAC %s", mac), zap.Error(err))
+			continue
+		}
+		t.logger.Info(fmt.Sprintf("%s lease of IP %s for MAC %s has expired", lease.State, lease.IP, mac))
+
+		if !registered {
+			continue
+		}
+		err = t.store.Update(mac, func(reg *common.Registration) error {
+			if reg.IP.Equal(lease.IP) {
+				reg.IP = nil
+			}
+			return nil
+		})
+		if err != nil {
+			t.logger.Error(fmt.Sprintf("failed to free IP %s of MAC %s", lease.IP, mac), zap.Error(err))
+			continue
+		}
+		t.logger.Info(fmt.Sprintf("IP %s has been freed from MAC %s", lease.IP, mac))
+	}
+
+	// Every renewal appends to the journal, so it is compacted here once enough entries have piled up.
+	if t.journal.Appended() >= compactThreshold+len(t.leases)+len(t.declined) {
+		if err := t.compact(); err != nil {
+			t.logger.Error("failed to compact lease journal", zap.Error(err))
+		}
+	}
+}
+
+// compact rewrites the journal with the current leases and quarantines only. t.mu must be held, or t not shared yet.
+func (t *LeaseTable) compact() error {
+	entries := make([]interface{}, 0, len(t.leases)+len(t.declined))
+	for _, lease := range t.leases {
+		entries = append(entries, leaseEntry{Op: "put", Lease: lease})
+	}
+	for _, lease := range t.declined {
+		entries = append(entries, leaseEntry{Op: "decline", Lease: lease})
+	}
+	return t.journal.Compact(entries)
+}
+
+// RunReaper reaps expired leases periodically until ctx is done.
+func (t *LeaseTable) RunReaper(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.Reap(now)
+		}
+	}
+}
+
+func (t *LeaseTable) put(lease *Lease) error {
+	err := t.journal.Append(leaseEntry{Op: "put", Lease: lease})
+	if err != nil {
+		return err
+	}
+	t.leases[lease.Macaddress] = lease
+	return nil
+}
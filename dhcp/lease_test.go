@@ -0,0 +1,251 @@
+package dhcp
+
+import (
+	"bytes"
+	"kickstart/common"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testMac = "00:50:56:aa:bb:01"
+
+func newTestLeaseTable(t *testing.T, dir string) (*LeaseTable, *common.Store) {
+	t.Helper()
+	store, err := common.NewStore(filepath.Join(dir, "registrations.journal"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	leases, err := NewLeaseTable(filepath.Join(dir, "leases.journal"), store, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewLeaseTable() error = %v", err)
+	}
+	t.Cleanup(func() { leases.Close() })
+	return leases, store
+}
+
+func registerTestHost(t *testing.T, store *common.Store, mac string, ip net.IP) {
+	t.Helper()
+	err := store.Upsert(mac, func(reg *common.Registration) error {
+		reg.IP = ip
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Upsert() error = %v", err)
+	}
+}
+
+func TestLeaseTable(t *testing.T) {
+	ip := net.ParseIP("172.16.0.10").To4()
+	otherIP := net.ParseIP("172.16.0.11").To4()
+	tests := []struct {
+		name       string
+		registered bool
+		run        func(leases *LeaseTable) error
+		reapAfter  time.Duration
+		wantState  LeaseState
+		wantLeases int
+		wantIP     net.IP
+	}{
+		{
+			name:       "offer is held",
+			registered: true,
+			run:        func(leases *LeaseTable) error { return leases.Offer(testMac, ip) },
+			wantState:  LeaseOffered,
+			wantLeases: 1,
+			wantIP:     ip,
+		},
+		{
+			name:       "offer expires",
+			registered: true,
+			run:        func(leases *LeaseTable) error { return leases.Offer(testMac, ip) },
+			reapAfter:  offerHoldTime + time.Second,
+			wantState:  LeaseExpired,
+			wantLeases: 1,
+		},
+		{
+			name:       "bind outlives the offer hold time",
+			registered: true,
+			run:        func(leases *LeaseTable) error { return leases.Bind(testMac, ip, time.Hour) },
+			reapAfter:  offerHoldTime + time.Second,
+			wantState:  LeaseBound,
+			wantLeases: 1,
+			wantIP:     ip,
+		},
+		{
+			name:       "bind expires",
+			registered: true,
+			run:        func(leases *LeaseTable) error { return leases.Bind(testMac, ip, time.Hour) },
+			reapAfter:  time.Hour + time.Second,
+			wantState:  LeaseExpired,
+			wantLeases: 1,
+		},
+		{
+			name:       "offer keeps the bound lease of the same IP",
+			registered: true,
+			run: func(leases *LeaseTable) error {
+				if err := leases.Bind(testMac, ip, time.Hour); err != nil {
+					return err
+				}
+				return leases.Offer(testMac, ip)
+			},
+			reapAfter:  offerHoldTime + time.Second,
+			wantState:  LeaseBound,
+			wantLeases: 1,
+			wantIP:     ip,
+		},
+		{
+			name:       "offer replaces the bound lease of another IP",
+			registered: true,
+			run: func(leases *LeaseTable) error {
+				if err := leases.Bind(testMac, otherIP, time.Hour); err != nil {
+					return err
+				}
+				return leases.Offer(testMac, ip)
+			},
+			wantState:  LeaseOffered,
+			wantLeases: 1,
+			wantIP:     ip,
+		},
+		{
+			name:       "release forgets the lease",
+			registered: true,
+			run: func(leases *LeaseTable) error {
+				if err := leases.Bind(testMac, ip, time.Hour); err != nil {
+					return err
+				}
+				return leases.Release(testMac)
+			},
+			wantLeases: 0,
+			wantIP:     ip,
+		},
+		{
+			name:       "expired lease of an unregistered host is dropped",
+			run:        func(leases *LeaseTable) error { return leases.Offer(testMac, ip) },
+			reapAfter:  offerHoldTime + time.Second,
+			wantLeases: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leases, store := newTestLeaseTable(t, t.TempDir())
+			if tt.registered {
+				registerTestHost(t, store, testMac, ip)
+			}
+			if err := tt.run(leases); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if tt.reapAfter > 0 {
+				leases.Reap(time.Now().Add(tt.reapAfter))
+				// Expired leases of unregistered hosts are dropped on the next pass.
+				leases.Reap(time.Now().Add(tt.reapAfter))
+			}
+
+			list := leases.List()
+			if len(list) != tt.wantLeases {
+				t.Fatalf("List() = %+v, want %d leases", list, tt.wantLeases)
+			}
+			if tt.wantLeases > 0 && list[0].State != tt.wantState {
+				t.Errorf("lease state = %s, want %s", list[0].State, tt.wantState)
+			}
+			if tt.registered {
+				reg, _ := store.Get(testMac)
+				if !reg.IP.Equal(tt.wantIP) {
+					t.Errorf("registration IP = %v, want %v", reg.IP, tt.wantIP)
+				}
+			}
+		})
+	}
+}
+
+func TestLeaseTableDecline(t *testing.T) {
+	ip := net.ParseIP("172.16.0.10").To4()
+	dir := t.TempDir()
+	leases, store := newTestLeaseTable(t, dir)
+	registerTestHost(t, store, testMac, ip)
+	if err := leases.Bind(testMac, ip, time.Hour); err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	if err := leases.Decline(testMac, ip, time.Hour); err != nil {
+		t.Fatalf("Decline() error = %v", err)
+	}
+	if list := leases.List(); len(list) != 0 {
+		t.Errorf("List() = %+v, want the lease of the declining host forgotten", list)
+	}
+
+	quarantined := func(store *common.Store) bool {
+		for _, used := range store.UsedIPs() {
+			if used.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if _, err := store.ReleaseIP(ip); err != nil {
+		t.Fatalf("ReleaseIP() error = %v", err)
+	}
+	if !quarantined(store) {
+		t.Fatalf("UsedIPs() = %v, want the declined IP kept out of the pool", store.UsedIPs())
+	}
+
+	// The quarantine survives a restart, while the store only keeps it in memory.
+	leases.Close()
+	store.UnquarantineIP(ip)
+	reopened, err := NewLeaseTable(filepath.Join(dir, "leases.journal"), store, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewLeaseTable() error = %v", err)
+	}
+	defer reopened.Close()
+	if !quarantined(store) {
+		t.Fatalf("UsedIPs() = %v, want the declined IP still quarantined after a restart", store.UsedIPs())
+	}
+
+	reopened.Reap(time.Now().Add(30 * time.Minute))
+	if !quarantined(store) {
+		t.Errorf("declined IP left the quarantine before the lease time")
+	}
+	reopened.Reap(time.Now().Add(time.Hour + time.Second))
+	if quarantined(store) {
+		t.Errorf("declined IP is still quarantined after the lease time")
+	}
+}
+
+func TestLeaseTableCompactsJournal(t *testing.T) {
+	defer func(threshold int) { compactThreshold = threshold }(compactThreshold)
+	compactThreshold = 10
+
+	ip := net.ParseIP("172.16.0.10").To4()
+	dir := t.TempDir()
+	leases, store := newTestLeaseTable(t, dir)
+	registerTestHost(t, store, testMac, ip)
+	for i := 0; i < 50; i++ {
+		if err := leases.Bind(testMac, ip, time.Hour); err != nil {
+			t.Fatalf("Bind() error = %v", err)
+		}
+	}
+	leases.Reap(time.Now())
+
+	path := filepath.Join(dir, "leases.journal")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte{'\n'}); lines != 1 {
+		t.Errorf("journal holds %d entries after Reap, want 1", lines)
+	}
+	leases.Close()
+
+	reopened, err := NewLeaseTable(path, store, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewLeaseTable() error = %v", err)
+	}
+	defer reopened.Close()
+	if list := reopened.List(); len(list) != 1 || list[0].State != LeaseBound || !list[0].IP.Equal(ip) {
+		t.Errorf("List() = %+v, want the bound lease of %s", list, ip)
+	}
+}
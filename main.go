@@ -8,6 +8,7 @@ import (
 	"kickstart/config"
 	"kickstart/dhcp"
 	"kickstart/tftp"
+	"kickstart/webhook"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -61,9 +62,19 @@ func main() {
 		return
 	}
 
-	go api.RunServer(ctx, config, logger, fileRootDirInfo)
-	go dhcp.RunServer(ctx, config, logger)
-	go tftp.RunServer(ctx, config, logger, fileRootDirInfo)
+	store, err := common.NewStore(filepath.Join(config.FileDirPath, "registrations.journal"))
+	if err != nil {
+		fmt.Printf("failed to load registrations: %v\n", err)
+		return
+	}
+	defer store.Close()
+
+	events := common.NewEventBus(store)
+
+	go api.RunServer(ctx, config, logger, fileRootDirInfo, store, events)
+	go dhcp.RunServer(ctx, config, logger, store, events)
+	go tftp.RunServer(ctx, config, logger, fileRootDirInfo, store, events)
+	go webhook.RunServer(ctx, config, logger, events)
 
 	<-sigChannel
 	cancel()
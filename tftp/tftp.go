@@ -8,22 +8,87 @@ import (
 	"io/fs"
 	"kickstart/common"
 	"kickstart/config"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/pin/tftp/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 )
 
+var (
+	tftpTransfers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ks_tftp_transfers_total",
+		Help: "TFTP transfers by file and outcome.",
+	}, []string{"file", "outcome"})
+	tftpBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ks_tftp_bytes_total",
+		Help: "Bytes sent over TFTP by file.",
+	}, []string{"file"})
+)
+
+// metricsHook counts finished TFTP transfers.
+type metricsHook struct{}
+
+func (metricsHook) OnSuccess(stats tftp.TransferStats) {
+	tftpTransfers.WithLabelValues(filepath.Base(stats.Filename), "success").Inc()
+}
+
+func (metricsHook) OnFailure(stats tftp.TransferStats, err error) {
+	tftpTransfers.WithLabelValues(filepath.Base(stats.Filename), "failure").Inc()
+}
+
 type Server struct {
 	logger          *zap.Logger
 	fileRootDirInfo *config.FileRootDirInfo
 	cfg             *config.Config
+	store           *common.Store
+	events          *common.EventBus
+}
+
+// transition moves the installation of the host holding ip forward to phase.
+func (s *Server) transition(ip net.IP, phase common.Phase) {
+	mac, moved, err := s.store.TransitionByIP(ip, phase)
+	if err != nil {
+		if err != common.ErrRegistrationNotFound {
+			s.logger.Error("failed to update installation status", zap.Error(err))
+		}
+		return
+	}
+	if moved {
+		s.logger.Info(fmt.Sprintf("installation of MAC %s moved to %s phase", mac, phase))
+	}
+}
+
+// fail marks the installation of mac as failed.
+func (s *Server) fail(mac string, reason error) {
+	if mac == "" {
+		return
+	}
+	failed, err := s.store.Fail(mac, reason.Error())
+	if err != nil {
+		if err != common.ErrRegistrationNotFound {
+			s.logger.Error("failed to update installation status", zap.Error(err))
+		}
+		return
+	}
+	if failed {
+		s.events.Publish(common.Event{Type: common.EventFailed, Macaddress: mac, Message: reason.Error()})
+	}
+}
+
+func (s *Server) publishFileServed(mac string, ip net.IP, filename string) {
+	event := common.Event{Type: common.EventTFTPFileServed, Macaddress: mac, File: filename}
+	if ip != nil {
+		event.IP = ip.String()
+	}
+	s.events.Publish(event)
 }
 
 func (s *Server) getReadHandler() func(string, io.ReaderFrom) error {
@@ -32,8 +97,18 @@ func (s *Server) getReadHandler() func(string, io.ReaderFrom) error {
 		var fullPath string
 		var file fs.File
 		var err error
+		var clientIP net.IP
+		if transfer, ok := rf.(tftp.OutgoingTransfer); ok {
+			remoteAddr := transfer.RemoteAddr()
+			clientIP = remoteAddr.IP
+		}
+		clientMac, _ := s.store.MacByIP(clientIP)
+		var phase common.Phase
 		switch filename {
 		case "autoexec.ipxe", "ipxe.efi", "pxelinux.0", "default", "undionly.kpxe":
+			if filename != "autoexec.ipxe" && filename != "default" {
+				phase = common.PhaseBootloader
+			}
 			ksTemplatefiles := common.GetKsTemplatefiles()
 			fullPath = filepath.Join("templates", filename)
 			file, err = ksTemplatefiles.Open(fullPath)
@@ -42,6 +117,7 @@ func (s *Server) getReadHandler() func(string, io.ReaderFrom) error {
 				return err
 			}
 		case "mboot.efi":
+			phase = common.PhaseBootloader
 			common.MbootMutex.RLock()
 			defer common.MbootMutex.RUnlock()
 			fullPath = filepath.Join(s.fileRootDirInfo.BootFileDirPath, filename)
@@ -58,34 +134,43 @@ func (s *Server) getReadHandler() func(string, io.ReaderFrom) error {
 			dir := filepath.Dir(filenamePath)
 			if len(esxi6xMatches) > 1 {
 				macAddr := strings.Replace(esxi6xMatches[1], "-", ":", -1)
-				common.MacFileMapMutex.RLock()
-				bootFileVersion, found := common.MacFileMap[macAddr]
-				common.MacFileMapMutex.RUnlock()
+				clientMac = macAddr
+				bootFileVersion, found := s.store.ISOFilename(macAddr)
 				if !found {
 					err = fmt.Errorf("mapped file not found")
 					s.logger.Error("failed to open boot file", zap.Error(err))
+					s.fail(clientMac, err)
 					return err
 				}
 				fullPath = fmt.Sprintf("%s/%s/boot.cfg", s.fileRootDirInfo.BootFileDirPath, bootFileVersion)
 				dir = bootFileVersion
 			}
-			tmpl, err := template.ParseFiles(fullPath)
+			tmpl, err := common.ParseBootCfgTemplate(fullPath)
 			if err != nil {
 				s.logger.Error("failed to open boot file", zap.Error(err))
+				s.fail(clientMac, err)
 				return err
 			}
-			data := common.LoadBootCfgTemplateData(s.cfg.ServicePortAddr.String(), strconv.Itoa(s.cfg.APIServerPort), dir)
+			ksPath, err := common.KSPath(s.store, s.cfg, clientMac)
+			if err != nil {
+				s.logger.Error("failed to issue ks token", zap.Error(err))
+			}
+			data := common.LoadBootCfgTemplateData(config.InstallerScheme(s.cfg), s.cfg.ServicePortAddr.String(), strconv.Itoa(s.cfg.BootServerPort), dir, ksPath)
 			var buf bytes.Buffer
 			err = tmpl.Execute(&buf, data)
 			if err != nil {
 				s.logger.Error("failed to update boot file template", zap.Error(err))
+				s.fail(clientMac, err)
 				return err
 			}
-			rf.ReadFrom(bytes.NewReader(buf.Bytes()))
+			n, err := rf.ReadFrom(bytes.NewReader(buf.Bytes()))
+			tftpBytes.WithLabelValues(filename).Add(float64(n))
 			if err != nil {
 				s.logger.Error("failed to send file", zap.Error(err))
 				return err
 			}
+			s.transition(clientIP, common.PhaseBootCfg)
+			s.publishFileServed(clientMac, clientIP, filenamePath)
 			return nil
 		default:
 			fullPath = filepath.Join(s.fileRootDirInfo.BootFileDirPath, filenamePath)
@@ -97,24 +182,33 @@ func (s *Server) getReadHandler() func(string, io.ReaderFrom) error {
 		}
 		defer file.Close()
 
-		_, err = rf.ReadFrom(file)
+		n, err := rf.ReadFrom(file)
+		tftpBytes.WithLabelValues(filename).Add(float64(n))
 		if err != nil {
 			if !strings.Contains(err.Error(), "User aborted the transfer") {
 				s.logger.Error("failed to send file", zap.Error(err))
 				return err
 			}
+			return nil
+		}
+		if phase != "" {
+			s.transition(clientIP, phase)
 		}
+		s.publishFileServed(clientMac, clientIP, filenamePath)
 		return nil
 	}
 }
 
-func RunServer(ctx context.Context, config *config.Config, logger *zap.Logger, fileRootDirInfo *config.FileRootDirInfo) {
+func RunServer(ctx context.Context, config *config.Config, logger *zap.Logger, fileRootDirInfo *config.FileRootDirInfo, store *common.Store, events *common.EventBus) {
 	srv := Server{
 		logger:          logger,
 		fileRootDirInfo: fileRootDirInfo,
 		cfg:             config,
+		store:           store,
+		events:          events,
 	}
 	s := tftp.NewServer(srv.getReadHandler(), nil)
+	s.SetHook(metricsHook{})
 	s.SetTimeout(5 * time.Second)
 	logger.Info("starting TFTP server...")
 	err := s.ListenAndServe(fmt.Sprintf("%s:69", config.ServicePortAddr))
@@ -0,0 +1,180 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"kickstart/common"
+	"kickstart/config"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	queueSize      = 256
+	requestTimeout = 10 * time.Second
+	initialBackoff = time.Second
+	maxBackoff     = time.Minute
+)
+
+type subscription struct {
+	cfg    config.WebhookConfig
+	events map[common.EventType]bool
+	queue  chan common.Event
+}
+
+// newSubscription returns the subscription of webhook, rejecting the events the server does not raise.
+func newSubscription(webhook config.WebhookConfig) (*subscription, error) {
+	sub := &subscription{
+		cfg:    webhook,
+		events: make(map[common.EventType]bool),
+		queue:  make(chan common.Event, queueSize),
+	}
+	for _, eventType := range webhook.Events {
+		if !common.EventType(eventType).Valid() {
+			return nil, fmt.Errorf("unknown event %q of webhook %s", eventType, webhook.URL)
+		}
+		sub.events[common.EventType(eventType)] = true
+	}
+	return sub, nil
+}
+
+func (s *subscription) match(event common.Event) bool {
+	return len(s.events) == 0 || s.events[event.Type]
+}
+
+type dispatcher struct {
+	logger        *zap.Logger
+	client        *http.Client
+	subscriptions []*subscription
+}
+
+func (d *dispatcher) run(ctx context.Context, sub *subscription) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-sub.queue:
+			d.deliver(ctx, sub, event)
+		}
+	}
+}
+
+// deliver posts event to the subscriber, retrying with exponential backoff until it is accepted.
+func (d *dispatcher) deliver(ctx context.Context, sub *subscription, event common.Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		d.logger.Error("failed to encode webhook event", zap.Error(err))
+		return
+	}
+
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		err = d.post(ctx, sub, event, body)
+		if err == nil {
+			d.logger.Info(fmt.Sprintf("delivered %s event of MAC %s to webhook %s", event.Type, event.Macaddress, sub.cfg.URL))
+			return
+		}
+		if attempt >= *sub.cfg.MaxRetries {
+			d.logger.Error(fmt.Sprintf("gave up delivering %s event of MAC %s to webhook %s", event.Type, event.Macaddress, sub.cfg.URL), zap.Error(err))
+			return
+		}
+		d.logger.Warn(fmt.Sprintf("failed to deliver %s event to webhook %s, retrying in %s", event.Type, sub.cfg.URL, backoff), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (d *dispatcher) post(ctx context.Context, sub *subscription, event common.Event, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Kickstart-Event", string(event.Type))
+	if sub.cfg.Secret != "" {
+		req.Header.Set("X-Kickstart-Signature", "sha256="+sign(sub.cfg.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body, which subscribers use to verify that the event came from this server.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RunServer delivers the events published on events to the webhooks configured in WEBHOOK_CONFIG_PATH.
+func RunServer(ctx context.Context, cfg *config.Config, logger *zap.Logger, events *common.EventBus) {
+	if cfg.WebhookConfigPath == "" {
+		return
+	}
+	webhooks, err := config.LoadWebhookConfig(cfg.WebhookConfigPath)
+	if err != nil {
+		logger.Error("failed to load webhook config", zap.Error(err))
+		return
+	}
+
+	d := &dispatcher{
+		logger: logger,
+		client: &http.Client{Timeout: requestTimeout},
+	}
+	for _, webhook := range webhooks {
+		sub, err := newSubscription(webhook)
+		if err != nil {
+			logger.Error("failed to load webhook config", zap.Error(err))
+			return
+		}
+		d.subscriptions = append(d.subscriptions, sub)
+	}
+	for _, sub := range d.subscriptions {
+		go d.run(ctx, sub)
+	}
+
+	received, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	logger.Info(fmt.Sprintf("starting webhook dispatcher for %d webhooks...", len(d.subscriptions)))
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("webhook dispatcher: shutting down...")
+			return
+		case event := <-received:
+			for _, sub := range d.subscriptions {
+				if !sub.match(event) {
+					continue
+				}
+				select {
+				case sub.queue <- event:
+				default:
+					logger.Warn(fmt.Sprintf("webhook %s is not keeping up, dropped %s event", sub.cfg.URL, event.Type))
+				}
+			}
+		}
+	}
+}